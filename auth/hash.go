@@ -0,0 +1,112 @@
+// Package auth helps BBS backends store passwords.
+//
+// Passwords are hashed with scrypt into a self-describing string like
+//
+//	$scrypt$v=1$ln=15,r=8,p=1$<salt>$<hash>
+//
+// so the parameters can be raised later without breaking old hashes.
+// Backends can use Hash and Verify directly, or hand Register and LogIn off to an Auth with a UserStore.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the version of the hash format
+const formatVersion = 1
+
+// ErrUnknownFormat is returned when verifying a hash this package didn't make.
+var ErrUnknownFormat = errors.New("auth: unknown hash format")
+
+// Params are scrypt cost parameters.
+type Params struct {
+	LogN    uint8 // CPU/memory cost, as a power of two
+	R       int   // block size
+	P       int   // parallelism
+	SaltLen int
+	KeyLen  int
+}
+
+// DefaultParams are the recommended scrypt parameters for interactive logins.
+var DefaultParams = Params{
+	LogN:    15,
+	R:       8,
+	P:       1,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var b64 = base64.RawStdEncoding
+
+// Hash hashes password with DefaultParams.
+func Hash(password string) (string, error) {
+	return HashWith(password, DefaultParams)
+}
+
+// HashWith hashes password with the given parameters.
+func HashWith(password string, p Params) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$v=%d$ln=%d,r=%d,p=%d$%s$%s",
+		formatVersion, p.LogN, p.R, p.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Verify reports whether password matches hash, in constant time.
+func Verify(password, hash string) (bool, error) {
+	p, salt, key, err := parse(hash)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash was made with parameters other than p (or an older format),
+// meaning it should be replaced with a new hash the next time the password is known.
+func NeedsRehash(hash string, p Params) bool {
+	old, salt, key, err := parse(hash)
+	if err != nil {
+		return true
+	}
+	return old.LogN != p.LogN || old.R != p.R || old.P != p.P ||
+		len(salt) != p.SaltLen || len(key) != p.KeyLen
+}
+
+func parse(hash string) (p Params, salt, key []byte, err error) {
+	// "", "scrypt", "v=1", "ln=15,r=8,p=1", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "scrypt" {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var v int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &v); err != nil || v != formatVersion {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if salt, err = b64.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if key, err = b64.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	p.SaltLen, p.KeyLen = len(salt), len(key)
+	return p, salt, key, nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// cheap enough for tests
+var testParams = Params{LogN: 4, R: 8, P: 1, SaltLen: 8, KeyLen: 16}
+
+func TestHashRoundTrip(t *testing.T) {
+	hash, err := HashWith("hunter2", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$scrypt$v=1$ln=4,r=8,p=1$") {
+		t.Errorf("unexpected format: %s", hash)
+	}
+	if ok, err := Verify("hunter2", hash); !ok || err != nil {
+		t.Errorf("Verify(right password) = %v, %v", ok, err)
+	}
+	if ok, err := Verify("hunter3", hash); ok || err != nil {
+		t.Errorf("Verify(wrong password) = %v, %v", ok, err)
+	}
+	if ok, err := Verify("", hash); ok || err != nil {
+		t.Errorf("Verify(empty password) = %v, %v", ok, err)
+	}
+	again, err := HashWith("hunter2", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == hash {
+		t.Error("two hashes of the same password are the same; is the salt random?")
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	hash, err := HashWith("hunter2", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	with := func(i int, s string) string {
+		p := append([]string(nil), parts...)
+		p[i] = s
+		return strings.Join(p, "$")
+	}
+	flip := func(s string) string {
+		c := byte('A')
+		if s[0] == 'A' {
+			c = 'B'
+		}
+		return string(c) + s[1:]
+	}
+
+	// still well-formed, but doesn't match anymore
+	for _, h := range []string{
+		with(3, "ln=5,r=8,p=1"),
+		with(4, flip(parts[4])),
+		with(5, flip(parts[5])),
+	} {
+		if ok, err := Verify("hunter2", h); ok || err != nil {
+			t.Errorf("Verify(%s) = %v, %v; want false, nil", h, ok, err)
+		}
+	}
+
+	// not something this package made
+	for _, h := range []string{
+		"",
+		"hunter2",
+		"$2a$10$abcdefghijklmnopqrstuv",
+		with(1, "bcrypt"),
+		with(2, "v=2"),
+		with(3, "ln=x,r=8,p=1"),
+		with(4, "not base64!"),
+		with(5, ""),
+		hash + "$extra",
+	} {
+		if ok, err := Verify("hunter2", h); ok || !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("Verify(%q) = %v, %v; want ErrUnknownFormat", h, ok, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := HashWith("hunter2", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NeedsRehash(hash, testParams) {
+		t.Error("fresh hash needs rehash")
+	}
+	changes := []func(*Params){
+		func(p *Params) { p.LogN++ },
+		func(p *Params) { p.R++ },
+		func(p *Params) { p.P++ },
+		func(p *Params) { p.SaltLen++ },
+		func(p *Params) { p.KeyLen++ },
+	}
+	for i, change := range changes {
+		p := testParams
+		change(&p)
+		if !NeedsRehash(hash, p) {
+			t.Errorf("change %d: %+v doesn't need rehash", i, p)
+		}
+	}
+	if !NeedsRehash("garbage", testParams) {
+		t.Error("unknown format doesn't need rehash")
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+var (
+	// ErrNoSuchUser is returned by a UserStore for users that don't exist.
+	ErrNoSuchUser = errors.New("auth: no such user")
+	// ErrUserExists is returned by a UserStore when creating a user that already exists.
+	ErrUserExists = errors.New("auth: user already exists")
+)
+
+// User is an account as kept by a UserStore.
+type User struct {
+	Name    string
+	Email   string
+	Hash    string // from Hash
+	Created time.Time
+}
+
+// UserStore is where an Auth keeps accounts. Backends implement it on top of their database.
+type UserStore interface {
+	// User returns the user called name, or ErrNoSuchUser.
+	User(name string) (User, error)
+	// CreateUser adds a new user, or returns ErrUserExists.
+	CreateUser(u User) error
+	// SetHash replaces a user's password hash.
+	SetHash(name, hash string) error
+}
+
+// Auth implements registering and logging in on top of a UserStore.
+// A backend's Register and LogIn methods can simply call these.
+type Auth struct {
+	Store  UserStore
+	Params Params // zero means DefaultParams
+}
+
+// Register creates an account for a "register" command.
+func (a Auth) Register(m bbs.RegisterCommand) (bbs.OKMessage, error) {
+	if m.Username == "" || m.Password == "" {
+		return bbs.OKMessage{}, bbs.NewError(bbs.CodeValidation, "Username and password are required")
+	}
+	hash, err := HashWith(m.Password, a.params())
+	if err != nil {
+		return bbs.OKMessage{}, err
+	}
+	err = a.Store.CreateUser(User{
+		Name:    m.Username,
+		Email:   m.Email,
+		Hash:    hash,
+		Created: time.Now(),
+	})
+	if errors.Is(err, ErrUserExists) {
+		return bbs.OKMessage{}, bbs.NewError(bbs.CodeValidation, "That username is taken")
+	}
+	if err != nil {
+		return bbs.OKMessage{}, err
+	}
+	return bbs.OK("register"), nil
+}
+
+// LogIn checks the password of a "login" command.
+// If the stored hash uses old parameters, it's replaced with a new one.
+func (a Auth) LogIn(m bbs.LoginCommand) bool {
+	u, err := a.Store.User(m.Username)
+	if err != nil {
+		// take as long as a wrong password would, so users can't be discovered by timing
+		HashWith(m.Password, a.params())
+		return false
+	}
+	ok, err := Verify(m.Password, u.Hash)
+	if err != nil {
+		log.Printf("auth: bad hash for user %s: %v", u.Name, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if NeedsRehash(u.Hash, a.params()) {
+		if hash, err := HashWith(m.Password, a.params()); err == nil {
+			if err := a.Store.SetHash(u.Name, hash); err != nil {
+				log.Printf("auth: couldn't rehash password for %s: %v", u.Name, err)
+			}
+		}
+	}
+	return true
+}
+
+func (a Auth) params() Params {
+	if a.Params == (Params{}) {
+		return DefaultParams
+	}
+	return a.Params
+}
+
+// MemoryStore is a UserStore that keeps users in memory, for testing and small servers.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func (s *MemoryStore) User(name string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, ErrNoSuchUser
+	}
+	return u, nil
+}
+
+func (s *MemoryStore) CreateUser(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[u.Name]; exists {
+		return ErrUserExists
+	}
+	if s.users == nil {
+		s.users = make(map[string]User)
+	}
+	s.users[u.Name] = u
+	return nil
+}
+
+func (s *MemoryStore) SetHash(name, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	u.Hash = hash
+	s.users[name] = u
+	return nil
+}
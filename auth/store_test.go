@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/guregu/bbs"
+)
+
+func TestAuth(t *testing.T) {
+	store := &MemoryStore{}
+	a := Auth{Store: store, Params: testParams}
+
+	if _, err := a.Register(bbs.RegisterCommand{Username: "alice", Password: "hunter2", Email: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.Register(bbs.RegisterCommand{Username: "alice", Password: "other"})
+	if !errors.Is(err, bbs.ErrValidation) {
+		t.Errorf("registering a taken name: %v", err)
+	}
+	if _, err := a.Register(bbs.RegisterCommand{Username: "bob"}); !errors.Is(err, bbs.ErrValidation) {
+		t.Errorf("registering without a password: %v", err)
+	}
+
+	u, err := store.User("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "a@example.com" || u.Hash == "hunter2" || NeedsRehash(u.Hash, testParams) {
+		t.Errorf("stored user: %+v", u)
+	}
+
+	if !a.LogIn(bbs.LoginCommand{Username: "alice", Password: "hunter2"}) {
+		t.Error("can't log in")
+	}
+	if a.LogIn(bbs.LoginCommand{Username: "alice", Password: "hunter3"}) {
+		t.Error("logged in with the wrong password")
+	}
+	if a.LogIn(bbs.LoginCommand{Username: "nobody", Password: "hunter2"}) {
+		t.Error("logged in as a user that doesn't exist")
+	}
+	if after, _ := store.User("alice"); after.Hash != u.Hash {
+		t.Error("hash changed without new params")
+	}
+}
+
+func TestAuthRehash(t *testing.T) {
+	store := &MemoryStore{}
+	old := Auth{Store: store, Params: testParams}
+	if _, err := old.Register(bbs.RegisterCommand{Username: "alice", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := store.User("alice")
+
+	stronger := testParams
+	stronger.LogN++
+	a := Auth{Store: store, Params: stronger}
+
+	// a wrong password doesn't rehash
+	if a.LogIn(bbs.LoginCommand{Username: "alice", Password: "wrong"}) {
+		t.Fatal("logged in with the wrong password")
+	}
+	if u, _ := store.User("alice"); u.Hash != before.Hash {
+		t.Error("rehashed after a failed login")
+	}
+
+	if !a.LogIn(bbs.LoginCommand{Username: "alice", Password: "hunter2"}) {
+		t.Fatal("can't log in with an old hash")
+	}
+	after, _ := store.User("alice")
+	if after.Hash == before.Hash || NeedsRehash(after.Hash, stronger) {
+		t.Errorf("not rehashed with new params: %s", after.Hash)
+	}
+	if ok, err := Verify("hunter2", after.Hash); !ok || err != nil {
+		t.Errorf("new hash doesn't verify: %v, %v", ok, err)
+	}
+	// and the new hash still logs in
+	if !a.LogIn(bbs.LoginCommand{Username: "alice", Password: "hunter2"}) {
+		t.Error("can't log in after rehash")
+	}
+}
+
+func TestAuthBadHash(t *testing.T) {
+	store := &MemoryStore{}
+	store.CreateUser(User{Name: "alice", Hash: "plaintext!"})
+	a := Auth{Store: store, Params: testParams}
+	if a.LogIn(bbs.LoginCommand{Username: "alice", Password: "plaintext!"}) {
+		t.Error("logged in against a hash in an unknown format")
+	}
+}
@@ -0,0 +1,43 @@
+package bbs
+
+import (
+	"context"
+	"strconv"
+)
+
+// most commands allowed in one batch
+const maxBatchSize = 50
+
+// batch runs each command in m through the middleware chain.
+// If one of them logs in, the rest use the new session.
+func (srv *Server) batch(ctx context.Context, m BatchCommand, sesh *Session) interface{} {
+	if len(m.Commands) > maxBatchSize {
+		return ErrorCode("batch", CodeValidation, "too many commands in batch (limit is "+strconv.Itoa(maxBatchSize)+")")
+	}
+	results := make([]interface{}, 0, len(m.Commands))
+	for _, data := range m.Commands {
+		var result interface{}
+		incoming, err := decodeCommand(data)
+		switch {
+		case err != nil:
+			result = errorFor("", err)
+		case incoming.Command == "batch":
+			result = ErrorCode("batch", CodeValidation, "batches can't be nested")
+		default:
+			result = srv.Handle(ctx, BBSCommand{incoming.Command}, data, sesh)
+		}
+		results = append(results, result)
+
+		switch r := result.(type) {
+		case WelcomeMessage:
+			if s := srv.Sessions.Get(r.Session); s != nil {
+				sesh = s
+			}
+		case ErrorMessage:
+			if m.StopOnError {
+				return BatchMessage{Command: "batch", Results: results}
+			}
+		}
+	}
+	return BatchMessage{Command: "batch", Results: results}
+}
@@ -1,6 +1,7 @@
 package main
 
 import "github.com/guregu/bbs"
+import "github.com/guregu/bbs/tagexpr"
 import "net/http"
 import "encoding/json"
 import "fmt"
@@ -19,6 +20,7 @@ var nextNext *next
 var listNext *listnext
 
 const client_version string = "test-client 0.1" //TODO: use this in User-Agent
+const protocolVersion = 1
 
 type next struct {
 	id    string
@@ -41,7 +43,7 @@ func testClient() {
 
 	fmt.Println("Running test client: " + client_version)
 	fmt.Printf("Connecting to %s...\n", bbsServer)
-	hello, _ := json.Marshal(&bbs.BBSCommand{"hello"})
+	hello, _ := json.Marshal(&bbs.HelloCommand{Command: "hello", Version: protocolVersion})
 	send(hello)
 
 	r := bufio.NewReader(os.Stdin)
@@ -68,7 +70,7 @@ func input(line string) {
 	case ".":
 		input(lastLine)
 	case "help":
-		fmt.Println("COMMANDS\n\tlogin username password\n\tnigol password username\n\tget topicID [filterID]\n\tboards\n\tlist [expression]\n\treply [topicID] [text]\n\tquit\n\thelp\n\t. (repeat last command)")
+		fmt.Println("COMMANDS\n\tlogin username password\n\tnigol password username\n\tget topicID [filterID]\n\tboards\n\ttags\n\tlist [expression]\n\treply [topicID] [text]\n\tquit\n\thelp\n\t. (repeat last command)")
 	case "quit":
 		os.Exit(0)
 	case "exit":
@@ -128,6 +130,9 @@ func input(line string) {
 	case "boards":
 		doListBoards()
 		lastLine = line
+	case "tags":
+		doListTags()
+		lastLine = line
 	case "reply":
 		args := strings.SplitN(line, " ", 3)
 		if len(args) < 3 {
@@ -169,11 +174,20 @@ func doRegister(u, pw string) {
 }
 
 func doLogin(u, pw string) {
-	login, _ := json.Marshal(&bbs.LoginCommand{"login", u, pw, 0, ""})
+	login, _ := json.Marshal(&bbs.LoginCommand{
+		Command:         "login",
+		Username:        u,
+		Password:        pw,
+		ProtocolVersion: protocolVersion,
+	})
 	send(login)
 }
 
 func doList(exp string) {
+	if _, err := tagexpr.Parse(exp); err != nil {
+		fmt.Println(err)
+		return
+	}
 	list, _ := json.Marshal(&bbs.ListCommand{"list", session, "thread", exp, ""})
 	send(list)
 }
@@ -183,6 +197,15 @@ func doListBoards() {
 	send(list)
 }
 
+func doListTags() {
+	list, _ := json.Marshal(&bbs.ListCommand{
+		Command: "list",
+		Session: session,
+		Type:    "tag",
+	})
+	send(list)
+}
+
 func doListNext(query, token string) {
 	nxt, _ := json.Marshal(&bbs.ListCommand{
 		Command: "list",
@@ -210,7 +233,13 @@ func doGetNext(t string, n string) {
 }
 
 func doReply(id, text string) {
-	reply, _ := json.Marshal(&bbs.ReplyCommand{"reply", session, id, text, "text"})
+	reply, _ := json.Marshal(&bbs.ReplyCommand{
+		Command: "reply",
+		Session: session,
+		To:      id,
+		Text:    text,
+		Format:  "text",
+	})
 	send(reply)
 }
 
@@ -276,11 +305,19 @@ func parse(js []byte) {
 			m := bbs.BoardListMessage{}
 			json.Unmarshal(js, &m)
 			onBoardList(&m)
+		} else if t.Type == "tag" {
+			m := bbs.TagListMessage{}
+			json.Unmarshal(js, &m)
+			onTagList(&m)
 		}
 	}
 }
 
 func onError(msg *bbs.ErrorMessage) {
+	if msg.Code != "" {
+		prettyPrint("Error on: "+msg.ReplyTo+" ("+msg.Code+")", msg.Error)
+		return
+	}
 	prettyPrint("Error on: "+msg.ReplyTo, msg.Error)
 }
 
@@ -339,6 +376,23 @@ func onBoardList(msg *bbs.BoardListMessage) {
 	}
 }
 
+func onTagList(msg *bbs.TagListMessage) {
+	prettyPrint("Tags", msg.Query)
+	for _, t := range msg.Tags {
+		info := ""
+		if t.Restricted {
+			info = " (Restricted)"
+		}
+		fmt.Printf("[%s]%s | %d threads\n", t.Name, info, t.ThreadCount)
+		if t.Description != "" {
+			fmt.Println(t.Description)
+		}
+		if len(t.Related) > 0 {
+			fmt.Println("Related: " + strings.Join(t.Related, ", "))
+		}
+	}
+}
+
 func send(js []byte) {
 	if verbose {
 		fmt.Println("client -> server")
@@ -1,17 +1,20 @@
 package bbs
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"code.google.com/p/go.net/websocket"
 )
 
 var name string
-var version int = 0
+var version int = 1 // newest protocol version we speak
 var options []string
 var description string
 var server_version string
@@ -45,6 +48,38 @@ type Bookmarks interface {
 	BookmarkList(m ListCommand) (BookmarkListMessage, error)
 }
 
+type Tags interface {
+	TagList(m ListCommand) (TagListMessage, error)
+}
+
+// Lister is implemented by BBSes that serve list types beyond the built-in ones.
+// ListTypes is checked once, when the server is created.
+type Lister interface {
+	ListTypes() []string
+	ListOf(m ListCommand) (interface{}, error)
+}
+
+// Authenticator can be implemented by backends that let users log in without a password,
+// or in more than one way. Logins with the "password" method always go to LogIn.
+type Authenticator interface {
+	// LoginMethods lists the methods users can log in with, like "password" and "token".
+	LoginMethods() []string
+	// Authenticate logs in with any other method, returning the user ID.
+	// For "anonymous" logins, the user ID can be empty.
+	Authenticate(m LoginCommand) (userID string, ok bool)
+}
+
+// ListHandler answers "list" commands of a particular type.
+type ListHandler func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error)
+
+// Handler runs a command and returns the reply to send back.
+// sesh is nil for commands sent without a (valid) session.
+type Handler func(ctx context.Context, cmd BBSCommand, data []byte, sesh *Session) interface{}
+
+// Middleware wraps a Handler, adding behavior around it.
+// It can inspect or rewrite commands and replies, or return its own reply without calling next.
+type Middleware func(next Handler) Handler
+
 type UnknownHandler interface {
 	Unknown(string, []byte) interface{}
 }
@@ -53,11 +88,43 @@ type Server struct {
 	Sessions *SessionHandler
 	Name     string
 	WS       http.Handler
+	SSE      http.Handler
+	Schema   http.Handler
+	// CORS controls cross-origin access. If nil, DefaultCORS is used.
+	CORS *CORS
+	// Strict makes the server reject commands with fields it doesn't know.
+	Strict bool
+	// MaxBodySize limits the size of a single command, in bytes.
+	// If zero, DefaultMaxBodySize is used.
+	MaxBodySize int64
+	// HTTPStatus makes POST replies use HTTP status codes that match the reply,
+	// like 401 for bad sessions or 404 for not_found errors, instead of always 200.
+	// The JSON body is the same either way.
+	HTTPStatus bool
+	// RequireSecure makes the server refuse "login" and "register" over plain HTTP,
+	// pointing clients to the SecureURL from the backend's "hello".
+	RequireSecure bool
+	// TrustedProxies are the addresses (IPs or CIDRs, like "10.0.0.0/8") of reverse proxies
+	// whose X-Forwarded-Proto header says whether the client connected securely,
+	// and whose X-Forwarded-For header says the client's address.
+	TrustedProxies []string
+	// Filters check posts, replies and registrations before the backend sees them, in order.
+	Filters []Filter
+	// Moderation gets content that a filter held back.
+	Moderation ModerationQueue
+	// Timeout, if set, limits how long each command may run.
+	// Backends see it as the deadline of the context passed to ContextBBS methods.
+	Timeout time.Duration
 
 	factory       func() BBS
 	userCommands  []string
 	guestCommands []string
+	secureURL     string
 	defaultBBS    BBS
+	lists         map[string]ListHandler
+	listTypes     []string
+	middleware    []Middleware
+	handler       Handler
 }
 
 func NewServer(factory func() BBS) *Server {
@@ -67,14 +134,124 @@ func NewServer(factory func() BBS) *Server {
 		factory:       factory,
 		defaultBBS:    defaultBBS,
 		Name:          hello.Name,
+		secureURL:     hello.SecureURL,
 		userCommands:  hello.Access.UserCommands,
 		guestCommands: hello.Access.GuestCommands,
+		lists:         make(map[string]ListHandler),
 	}
 	srv.Sessions = NewSessionHandler(srv)
-	srv.WS = websocket.Handler(srv.ServeWebsocket)
+	srv.WS = websocket.Server{
+		Handler:   srv.ServeWebsocket,
+		Handshake: srv.checkOrigin,
+	}
+	srv.SSE = http.HandlerFunc(srv.ServeSSE)
+	srv.Schema = http.HandlerFunc(ServeSchema)
+	srv.handler = srv.do
+	srv.registerLists()
 	return srv
 }
 
+// Use adds middleware around command handling, for both HTTP and websocket clients.
+// Middleware added first runs first; the server's built-in handling is always innermost.
+// It should be called before serving.
+func (srv *Server) Use(mw ...Middleware) {
+	srv.middleware = append(srv.middleware, mw...)
+	h := Handler(srv.do)
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		h = srv.middleware[i](h)
+	}
+	srv.handler = h
+}
+
+// Handle runs a command through the middleware chain and returns the reply.
+func (srv *Server) Handle(ctx context.Context, cmd BBSCommand, data []byte, sesh *Session) interface{} {
+	if srv.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.Timeout)
+		defer cancel()
+	}
+	return srv.handler(ctx, cmd, data, sesh)
+}
+
+// HandleList registers h as the handler for "list" commands of the given type,
+// replacing any existing handler. It should be called before serving.
+func (srv *Server) HandleList(typ string, h ListHandler) {
+	if _, exists := srv.lists[typ]; !exists {
+		srv.listTypes = append(srv.listTypes, typ)
+	}
+	srv.lists[typ] = h
+}
+
+// ListTypes returns the registered list types, in order of registration.
+func (srv *Server) ListTypes() []string {
+	return append([]string(nil), srv.listTypes...)
+}
+
+func (srv *Server) registerLists() {
+	srv.HandleList("thread", func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error) {
+		return list(ctx, bbs, m)
+	})
+	if _, ok := srv.defaultBBS.(Boards); ok {
+		srv.HandleList("board", func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error) {
+			if b, ok := bbs.(Boards); ok {
+				return b.BoardList(m)
+			}
+			return nil, errUnsupportedList
+		})
+	}
+	if _, ok := srv.defaultBBS.(Bookmarks); ok {
+		srv.HandleList("bookmark", func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error) {
+			if b, ok := bbs.(Bookmarks); ok {
+				return b.BookmarkList(m)
+			}
+			return nil, errUnsupportedList
+		})
+	}
+	if _, ok := srv.defaultBBS.(Tags); ok {
+		srv.HandleList("tag", func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error) {
+			if t, ok := bbs.(Tags); ok {
+				return t.TagList(m)
+			}
+			return nil, errUnsupportedList
+		})
+	}
+	if l, ok := srv.defaultBBS.(Lister); ok {
+		for _, typ := range l.ListTypes() {
+			srv.HandleList(typ, func(ctx context.Context, bbs BBS, m ListCommand) (interface{}, error) {
+				if l, ok := bbs.(Lister); ok {
+					return l.ListOf(m)
+				}
+				return nil, errUnsupportedList
+			})
+		}
+	}
+}
+
+// for list handlers whose backend doesn't support that type after all
+var errUnsupportedList = NewError(CodeUnsupported, "unsupported")
+
+// hello fills in the lists we know about.
+// Only registered types are listed, since the rest would answer "unsupported".
+func (srv *Server) hello(bbs BBS) HelloMessage {
+	hello := bbs.Hello()
+	hello.Lists = srv.ListTypes()
+	if a, ok := bbs.(Authenticator); ok {
+		hello.LoginMethods = a.LoginMethods()
+	}
+	if c := srv.challenge(); c != nil {
+		hello.Challenge = c
+	}
+	return hello
+}
+
+// loginMethods returns the ways users can log in to b
+func loginMethods(b BBS) []string {
+	if a, ok := b.(Authenticator); ok {
+		return a.LoginMethods()
+	}
+	return []string{LoginPassword}
+}
+
 func (srv *Server) NewBBS() BBS {
 	return srv.factory()
 }
@@ -83,7 +260,7 @@ func (srv *Server) DefaultBBS() BBS {
 	return srv.defaultBBS
 }
 
-func (srv *Server) do(incoming BBSCommand, data []byte, sesh *Session) interface{} {
+func (srv *Server) do(ctx context.Context, incoming BBSCommand, data []byte, sesh *Session) interface{} {
 	var bbs BBS
 	if sesh != nil {
 		bbs = sesh.BBS
@@ -93,19 +270,45 @@ func (srv *Server) do(incoming BBSCommand, data []byte, sesh *Session) interface
 			return SessionErrorMessage
 		}
 	}
+	if sesh != nil && incoming.Command != "batch" && incoming.Command != "poll" {
+		// connections share the session's backend, so they take turns
+		sesh.backend.Lock()
+		defer sesh.backend.Unlock()
+	}
 	switch incoming.Command {
 	case "hello":
-		return bbs.Hello()
+		m := HelloCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor("hello", err)
+		}
+		v, ok := negotiate(m.MinVersion, m.Version)
+		if !ok {
+			return unsupportedVersion("hello")
+		}
+		setConnVersion(ctx, v)
+		hello := srv.hello(bbs)
+		hello.ProtocolVersion = v
+		hello.MinVersion = minVersion
+		hello.MaxVersion = version
+		return hello
 	case "login":
+		if err := srv.checkSecure(ctx); err != nil {
+			return errorFor("login", err)
+		}
 		m := LoginCommand{}
-		json.Unmarshal(data, &m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		v, ok := negotiate(m.MinVersion, m.ProtocolVersion)
+		if !ok {
+			return unsupportedVersion("login")
+		}
 		// re-logins:
 		if m.Session != "" {
+			// the connection switches to the session when it sees the welcome
 			found := srv.Sessions.Get(m.Session)
 			if found != nil {
-				if sesh != nil {
-					srv.Sessions.Copy(found, sesh)
-				}
+				setConnVersion(ctx, v)
 				return WelcomeMessage{"welcome", found.UserID, found.SessionID}
 			} else {
 				// in the future, let people supply username/password for a second try
@@ -113,82 +316,176 @@ func (srv *Server) do(incoming BBSCommand, data []byte, sesh *Session) interface
 			}
 		}
 		// normal logins:
-		if sesh != nil {
-			if ok := srv.Sessions.Upgrade(sesh, m); !ok {
-				return Error("login", "nope")
+		if m.Method == "" {
+			m.Method = LoginPassword
+		}
+		if !contains(loginMethods(bbs), m.Method) {
+			return ErrorCode("login", CodeUnsupported, "Unsupported login method: "+m.Method)
+		}
+		if err := srv.Sessions.checkLogin(ctx, m); err != nil {
+			return errorFor("login", err)
+		}
+		if sesh != nil && sesh.SessionID == "" {
+			// websocket guests become logged in
+			if ok := srv.Sessions.UpgradeContext(ctx, sesh, m); !ok {
+				return ErrorCode("login", CodeLoginFailed, "nope")
 			}
 		} else {
-			sesh = srv.Sessions.TryLogin(m)
+			sesh = srv.Sessions.TryLoginContext(ctx, m)
 		}
 
 		if sesh == nil {
-			return Error("login", "Can't log in!")
+			return ErrorCode("login", CodeLoginFailed, "Can't log in!")
 		}
+		// the version logged in with is the default for the session's other connections
+		sesh.setVersion(v)
+		setConnVersion(ctx, v)
 		return WelcomeMessage{"welcome", sesh.UserID, sesh.SessionID}
 	case "register":
+		if err := srv.checkSecure(ctx); err != nil {
+			return errorFor("register", err)
+		}
 		m := RegisterCommand{}
-		json.Unmarshal(data, &m)
-		ok, err := bbs.Register(m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		c := Content{Command: "register", Username: m.Username, Email: m.Email, Challenge: m.Challenge, Data: data}
+		if res := srv.screen(ctx, &c, sesh); res != nil {
+			return res
+		}
+		ok, err := register(ctx, bbs, m)
 		if err != nil {
-			return Error("register", err.Error())
+			return errorFor("register", err)
 		}
+		srv.accepted(ctx, &c)
 		return ok
 	case "get":
 		m := GetCommand{}
-		json.Unmarshal(data, &m)
-		ok, err := bbs.Get(m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		ok, err := get(ctx, bbs, m)
 		if err != nil {
-			return Error("get", err.Error())
+			return errorFor("get", err)
 		}
 		return ok
 	case "list":
 		m := ListCommand{}
-		json.Unmarshal(data, &m)
-		switch m.Type {
-		case "thread", "":
-			ok, err := bbs.List(m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		typ := m.Type
+		if typ == "" {
+			typ = "thread"
+		}
+		if h, ok := srv.lists[typ]; ok {
+			msg, err := h(ctx, bbs, m)
 			if err != nil {
-				return Error("list", err.Error())
-			}
-			return ok
-		case "board":
-			if b, ok := bbs.(Boards); ok {
-				msg, err := b.BoardList(m)
-				if err != nil {
-					return Error("list", err.Error())
-				}
-				return msg
-			}
-		case "bookmark":
-			if b, ok := bbs.(Bookmarks); ok {
-				msg, err := b.BookmarkList(m)
-				if err != nil {
-					return Error("list", err.Error())
-				}
-				return msg
+				return errorFor("list", err)
 			}
+			return msg
 		}
-		return Error("list", "unsupported")
+		return errorFor("list", errUnsupportedList)
 	case "reply":
 		m := ReplyCommand{}
-		json.Unmarshal(data, &m)
-		ok, err := bbs.Reply(m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		c := Content{Command: "reply", To: m.To, Text: m.Text, Challenge: m.Challenge, Data: data}
+		if res := srv.screen(ctx, &c, sesh); res != nil {
+			return res
+		}
+		ok, err := reply(ctx, bbs, m)
 		if err != nil {
-			return Error("reply", err.Error())
+			return errorFor("reply", err)
 		}
+		srv.accepted(ctx, &c)
 		return ok
 	case "post":
 		m := PostCommand{}
-		json.Unmarshal(data, &m)
-		ok, err := bbs.Post(m)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		c := Content{Command: "post", Title: m.Title, Text: m.Text, Challenge: m.Challenge, Data: data}
+		if res := srv.screen(ctx, &c, sesh); res != nil {
+			return res
+		}
+		ok, err := post(ctx, bbs, m)
 		if err != nil {
-			return Error("post", err.Error())
+			return errorFor("post", err)
 		}
+		srv.accepted(ctx, &c)
 		return ok
+	case "listen", "part":
+		r, ok := bbs.(Realtime)
+		if !ok {
+			return ErrorCode(incoming.Command, CodeUnsupported, "realtime unsupported")
+		}
+		if sesh == nil {
+			return SessionErrorMessage
+		}
+		m := ListenCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		srv.eventsLocked(sesh)
+		var msg OKMessage
+		var err error
+		if incoming.Command == "listen" {
+			msg, err = r.Listen(m)
+		} else {
+			msg, err = r.Part(m)
+		}
+		if err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		return msg
+	case "batch":
+		m := BatchCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor("batch", err)
+		}
+		return srv.batch(ctx, m, sesh)
+	case "poll":
+		if sesh == nil {
+			return SessionErrorMessage
+		}
+		m := PollCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor("poll", err)
+		}
+		msg, err := srv.poll(ctx, sesh, m)
+		if err != nil {
+			return errorFor("poll", err)
+		}
+		return msg
+	case "sessions":
+		if sesh == nil || sesh.SessionID == "" {
+			return SessionErrorMessage
+		}
+		m := SessionsCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor("sessions", err)
+		}
+		return srv.Sessions.list(sesh)
+	case "revoke":
+		if sesh == nil || sesh.SessionID == "" {
+			return SessionErrorMessage
+		}
+		m := RevokeCommand{}
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor("revoke", err)
+		}
+		if err := srv.Sessions.revokeFor(sesh, m); err != nil {
+			return errorFor("revoke", err)
+		}
+		return OK("revoke")
 	case "logout":
 		m := LogoutCommand{}
-		json.Unmarshal(data, &m)
-		srv.Sessions.Logout(m.Session)
+		if err := srv.decode(data, &m); err != nil {
+			return errorFor(incoming.Command, err)
+		}
+		srv.Sessions.logout(m.Session, sesh)
 		return bbs.LogOut(m)
 	default:
 		if b, ok := bbs.(UnknownHandler); ok {
@@ -197,7 +494,7 @@ func (srv *Server) do(incoming BBSCommand, data []byte, sesh *Session) interface
 				return result
 			}
 		}
-		return Error(incoming.Command, "Unknown command: "+incoming.Command)
+		return ErrorCode(incoming.Command, CodeUnknownCommand, "Unknown command: "+incoming.Command)
 	}
 	return nil
 }
@@ -208,26 +505,63 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		//Display info
 		index(w, r)
 	case "OPTIONS":
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		srv.cors().apply(w, r)
 	case "POST":
 		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		if !srv.cors().apply(w, r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(jsonify(ErrorCode("", CodeForbidden, "origin not allowed")))
+			return
+		}
 
-		data, _ := ioutil.ReadAll(r.Body)
-		incoming := UserCommand{}
-		err := json.Unmarshal(data, &incoming)
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, srv.maxBodySize()))
+		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				srv.reply(w, errorFor("", tooLarge(tooBig.Limit)), srv.errorVersion(data))
+			}
+			return
+		}
+		incoming, err := decodeCommand(data)
 		if err != nil {
-			fmt.Println("JSON Parsing Error!! " + string(data))
+			srv.reply(w, errorFor("", err), srv.errorVersion(data))
 			return
 		}
 		sesh := srv.Sessions.Get(incoming.Session)
-		result := srv.do(BBSCommand{incoming.Command}, data, sesh)
-		w.Write(jsonify(result))
+		ctx, cv := withConnVersion(srv.withRequest(r.Context(), r))
+		if sesh == nil {
+			v, _ := negotiate(0, incoming.Version)
+			setConnVersion(ctx, v)
+		}
+		result := srv.Handle(ctx, BBSCommand{incoming.Command}, data, sesh)
+		srv.reply(w, result, cv.get(sesh))
 	default:
 		log.Println("Weird method used: " + r.Method)
+		if srv.HTTPStatus {
+			w.Header().Set("Allow", "POST, GET, OPTIONS")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(jsonify(ErrorCode("", CodeUnsupported, "method not allowed: "+r.Method)))
+		}
+	}
+}
+
+// reply writes the result of a POSTed command
+func (srv *Server) reply(w http.ResponseWriter, result interface{}, v int) {
+	if srv.HTTPStatus {
+		if msg, ok := result.(ErrorMessage); ok && msg.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(msg.RetryAfter))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(httpStatus(result))
+	}
+	w.Write(jsonify(adapt(result, v)))
+}
+
+func (srv *Server) checkOrigin(config *websocket.Config, r *http.Request) error {
+	if !srv.cors().allows(r.Header.Get("Origin")) {
+		return errors.New("origin not allowed")
 	}
+	return nil
 }
 
 func (srv *Server) ServeWebsocket(socket *websocket.Conn) {
@@ -254,19 +588,25 @@ func index(w http.ResponseWriter, r *http.Request) {
 }
 
 func Serve(address string, path string, fact func() BBS) {
-	srv := NewServer(fact)
-	http.HandleFunc("/", index)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.Handle(path, srv)
-	http.Handle("/ws", websocket.Handler(srv.ServeWebsocket))
-	hm := srv.defaultBBS.Hello()
-	log.Printf("Starting BBS %s at %s%s\n", hm.Name, address, path)
+	srv := mount(path, fact)
+	log.Printf("Starting BBS %s at %s%s\n", srv.Name, address, path)
 	err := http.ListenAndServe(address, nil)
 	if err != nil {
 		panic(err)
 	}
 }
 
+func mount(path string, fact func() BBS) *Server {
+	srv := NewServer(fact)
+	http.HandleFunc("/", index)
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.Handle(path, srv)
+	http.Handle("/ws", srv.WS)
+	http.Handle("/events", srv.SSE)
+	http.Handle(SchemaPath, srv.Schema)
+	return srv
+}
+
 func Error(wrt, msg string) ErrorMessage {
 	return ErrorMessage{
 		Command: "error",
@@ -275,6 +615,13 @@ func Error(wrt, msg string) ErrorMessage {
 	}
 }
 
+// ErrorCode is like Error, with a machine-readable code (see the Code constants).
+func ErrorCode(wrt, code, msg string) ErrorMessage {
+	m := Error(wrt, msg)
+	m.Code = code
+	return m
+}
+
 func OK(wrt string) OKMessage {
 	return OKMessage{
 		Command: "ok",
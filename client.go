@@ -1,8 +1,10 @@
 package bbs
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"strconv"
+	"sync"
 
 	"code.google.com/p/go.net/websocket"
 )
@@ -13,21 +15,41 @@ type client struct {
 	srv    *Server
 	socket *websocket.Conn
 	sesh   *Session
+	// negotiated by this connection's "hello" or "login"
+	version *connVersion
 
 	sendq chan interface{}
+
+	// canceled when the socket closes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// forwarding realtime events from the session's log
+	following *eventLog
+	stop      chan struct{}
+	pumping   sync.WaitGroup
 }
 
 func newClient(srv *Server, socket *websocket.Conn) *client {
-	return &client{
-		srv:    srv,
-		socket: socket,
-		sendq:  make(chan interface{}, sendQueueSize),
-		sesh:   &Session{BBS: srv.NewBBS()},
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, version := withConnVersion(srv.withRequest(ctx, socket.Request()))
+	c := &client{
+		srv:     srv,
+		socket:  socket,
+		version: version,
+		sendq:   make(chan interface{}, sendQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
+	c.use(&Session{BBS: srv.NewBBS()})
+	return c
 }
 
 func (c *client) Send(msg interface{}) {
-	c.sendq <- msg
+	select {
+	case c.sendq <- msg:
+	case <-c.ctx.Done():
+	}
 }
 
 func (c *client) writer() {
@@ -41,6 +63,7 @@ func (c *client) writer() {
 			err := websocket.JSON.Send(c.socket, msg)
 			if err != nil {
 				// disconnect etc
+				c.cancel()
 				return
 			}
 		}
@@ -49,9 +72,7 @@ func (c *client) writer() {
 
 func (c *client) run() {
 	defer c.cleanup()
-	if r, ok := c.sesh.BBS.(Realtime); ok {
-		r.Connect(c)
-	}
+	c.follow(0, false)
 	for {
 		var data []byte
 		err := websocket.Message.Receive(c.socket, &data)
@@ -59,30 +80,208 @@ func (c *client) run() {
 			break
 		}
 
-		incoming := BBSCommand{}
-		err = json.Unmarshal(data, &incoming)
+		// websocket reads the whole frame first, so this only keeps giant commands away from the backend
+		if limit := c.srv.maxBodySize(); int64(len(data)) > limit {
+			c.reply(errorFor("", tooLarge(limit)))
+			continue
+		}
+		incoming, err := decodeCommand(data)
 		if err != nil {
-			fmt.Println("JSON Parsing Error!! " + string(data))
+			c.reply(errorFor("", err))
+			continue
+		}
+		if incoming.Command == "resume" {
+			c.resume(data)
+			continue
+		}
+		if c.loggedOut() {
+			// logged out or revoked somewhere else
+			c.logout()
+			c.reply(SessionErrorMessage)
 			continue
 		}
-		result := c.srv.do(incoming, data, c.sesh)
-		/*
-			switch result := result.(type) {
-			case WelcomeMessage:
+		result := c.srv.Handle(c.ctx, BBSCommand{incoming.Command}, data, c.sesh)
+		if w, ok := welcome(result); ok {
+			// logging in or re-logging in attaches us to that session
+			if found := c.srv.Sessions.Get(w.Session); found != nil && found != c.sesh {
+				c.use(found)
+				c.follow(0, false)
+			}
+		}
+		c.reply(result)
+		if c.loggedOut() {
+			c.logout()
+		}
+	}
+}
+
+// welcome returns the last "welcome" message in a result, if any
+func welcome(result interface{}) (WelcomeMessage, bool) {
+	switch r := result.(type) {
+	case WelcomeMessage:
+		return r, true
+	case BatchMessage:
+		for i := len(r.Results) - 1; i >= 0; i-- {
+			if w, ok := r.Results[i].(WelcomeMessage); ok {
+				return w, true
+			}
+		}
+	}
+	return WelcomeMessage{}, false
+}
+
+// use attaches the connection to sesh, detaching it from the current session
+func (c *client) use(sesh *Session) {
+	if c.sesh != nil {
+		c.bye()
+		c.sesh.detach()
+	}
+	sesh.attach()
+	c.sesh = sesh
+}
+
+// loggedOut reports whether our session was logged out, here or by another connection
+func (c *client) loggedOut() bool {
+	return c.sesh.SessionID != "" && c.srv.Sessions.Get(c.sesh.SessionID) == nil
+}
+
+// reply sends the result of a command, in the format the client expects
+func (c *client) reply(result interface{}) {
+	c.Send(adapt(result, c.version.get(c.sesh)))
+}
+
+// logout drops the session, going back to being a guest
+func (c *client) logout() {
+	// keep speaking the same version as a guest
+	setConnVersion(c.ctx, c.version.get(c.sesh))
+	c.use(&Session{BBS: c.srv.NewBBS()})
+	c.follow(0, false)
+}
 
+// resume attaches this connection to an existing session,
+// replaying the realtime events the client missed since it last saw m.Seq.
+func (c *client) resume(data []byte) {
+	m := ResumeCommand{}
+	if err := c.srv.decode(data, &m); err != nil {
+		c.reply(errorFor("resume", err))
+		return
+	}
+	found := c.srv.Sessions.Get(m.Session)
+	if found == nil {
+		c.reply(SessionErrorMessage)
+		return
+	}
+	log := c.srv.events(found)
+	_, ok := log.since(m.Seq)
+	latest, _ := log.wait()
+	c.use(found)
+	c.Send(ResumeMessage{
+		Command:  "resume",
+		Username: found.UserID,
+		Session:  found.SessionID,
+		Seq:      latest,
+		Resync:   !ok,
+	})
+	if ok {
+		c.follow(m.Seq, true)
+	} else {
+		c.follow(latest, true)
+	}
+}
+
+// follow forwards realtime events from the current session's log to the socket, starting after cursor.
+// Unless force is set, it does nothing if we're already following that log.
+func (c *client) follow(cursor uint64, force bool) {
+	log := c.srv.events(c.sesh)
+	if log == c.following && !force {
+		return
+	}
+	if c.stop != nil {
+		close(c.stop)
+		c.pumping.Wait()
+	}
+	if !force {
+		cursor, _ = log.wait()
+	}
+	c.following = log
+	c.stop = make(chan struct{})
+	c.pumping.Add(1)
+	go c.pump(c.sesh, log, cursor, c.stop)
+}
+
+func (c *client) pump(sesh *Session, log *eventLog, cursor uint64, stop <-chan struct{}) {
+	defer c.pumping.Done()
+	for {
+		latest, wake := log.wait()
+		if latest > cursor {
+			evs, ok := log.since(cursor)
+			if !ok {
+				// we fell too far behind
+				c.Send(ResyncMessage)
 			}
-		*/
-		c.Send(result)
+			for _, ev := range evs {
+				select {
+				case c.sendq <- realtime(c.version.get(sesh), ev):
+				case <-stop:
+					return
+				case <-c.ctx.Done():
+					return
+				}
+				cursor = ev.Seq
+			}
+			continue
+		}
+		select {
+		case <-wake:
+		case <-stop:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// bye disconnects the backend from realtime events, unless the session is logged in.
+// Logged-in sessions keep collecting events so clients can resume, until they log out.
+func (c *client) bye() {
+	if c.sesh == nil || c.sesh.SessionID != "" {
+		return
+	}
+	if r, ok := c.sesh.BBS.(Realtime); ok {
+		r.Bye()
 	}
 }
 
 func (c *client) cleanup() {
 	// post-disconnect cleanup
+	c.cancel()
 	c.socket.Close()
+	if c.stop != nil {
+		close(c.stop)
+		c.pumping.Wait()
+	}
 	close(c.sendq)
-	if c.sesh != nil {
-		if r, ok := c.sesh.BBS.(Realtime); ok {
-			r.Bye()
-		}
+	c.bye()
+	c.sesh.detach()
+}
+
+// realtime formats a realtime event for the client's protocol version
+func realtime(v int, ev event) interface{} {
+	if v < 1 {
+		return adapt(ev.Msg, 0)
+	}
+	return withSeq(ev.Msg, ev.Seq)
+}
+
+// withSeq adds a "seq" field with the event's sequence number to a realtime message.
+func withSeq(msg interface{}, seq uint64) interface{} {
+	b, err := json.Marshal(msg)
+	if err != nil || len(b) < 2 || b[0] != '{' {
+		return msg
+	}
+	field := `{"seq":` + strconv.FormatUint(seq, 10)
+	if string(b) == "{}" {
+		return json.RawMessage(field + "}")
 	}
+	return json.RawMessage(field + "," + string(b[1:]))
 }
@@ -0,0 +1,103 @@
+package bbs
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// ContextBBS is implemented by BBSes that can stop working when a request is canceled,
+// for example when an HTTP client disconnects, a websocket closes, or Server.Timeout passes.
+// The server prefers these methods over their plain BBS counterparts.
+type ContextBBS interface {
+	RegisterContext(ctx context.Context, m RegisterCommand) (OKMessage, error)
+	LogInContext(ctx context.Context, m LoginCommand) bool
+	GetContext(ctx context.Context, m GetCommand) (ThreadMessage, error)
+	ListContext(ctx context.Context, m ListCommand) (ListMessage, error)
+	ReplyContext(ctx context.Context, m ReplyCommand) (OKMessage, error)
+	PostContext(ctx context.Context, m PostCommand) (OKMessage, error)
+}
+
+func register(ctx context.Context, bbs BBS, m RegisterCommand) (OKMessage, error) {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.RegisterContext(ctx, m)
+	}
+	return bbs.Register(m)
+}
+
+func logIn(ctx context.Context, bbs BBS, m LoginCommand) bool {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.LogInContext(ctx, m)
+	}
+	return bbs.LogIn(m)
+}
+
+func get(ctx context.Context, bbs BBS, m GetCommand) (ThreadMessage, error) {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.GetContext(ctx, m)
+	}
+	return bbs.Get(m)
+}
+
+func list(ctx context.Context, bbs BBS, m ListCommand) (ListMessage, error) {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.ListContext(ctx, m)
+	}
+	return bbs.List(m)
+}
+
+func reply(ctx context.Context, bbs BBS, m ReplyCommand) (OKMessage, error) {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.ReplyContext(ctx, m)
+	}
+	return bbs.Reply(m)
+}
+
+func post(ctx context.Context, bbs BBS, m PostCommand) (OKMessage, error) {
+	if c, ok := bbs.(ContextBBS); ok {
+		return c.PostContext(ctx, m)
+	}
+	return bbs.Post(m)
+}
+
+type ctxKey int
+
+const (
+	remoteAddrKey ctxKey = iota
+	userAgentKey
+	secureKey
+	versionKey
+)
+
+// RemoteAddr returns the IP address of the client that sent a command, or "" if unknown.
+// Middleware can use it with the context passed to a Handler.
+func RemoteAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey).(string)
+	return addr
+}
+
+func withRemoteAddr(ctx context.Context, addr string) context.Context {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+// UserAgent returns the User-Agent of the client that sent a command, or "" if unknown.
+func UserAgent(ctx context.Context) string {
+	ua, _ := ctx.Value(userAgentKey).(string)
+	return ua
+}
+
+// Secure reports whether the command came over HTTPS (or a secure websocket).
+func Secure(ctx context.Context) bool {
+	secure, _ := ctx.Value(secureKey).(bool)
+	return secure
+}
+
+// withRequest adds the client's address, user agent, and whether it's secure from r to ctx
+func (srv *Server) withRequest(ctx context.Context, r *http.Request) context.Context {
+	ctx = withRemoteAddr(ctx, srv.clientAddr(r))
+	ctx = context.WithValue(ctx, secureKey, srv.secure(r))
+	return context.WithValue(ctx, userAgentKey, r.UserAgent())
+}
@@ -0,0 +1,80 @@
+package bbs
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS controls which web pages may talk to the server, over both HTTP and websockets.
+type CORS struct {
+	// AllowedOrigins lists origins like "https://example.com". "*" allows any origin,
+	// unless AllowCredentials is set.
+	AllowedOrigins []string
+	// AllowedHeaders lists request headers clients may send, for preflight requests.
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache preflight results.
+	MaxAge time.Duration
+	// AllowCredentials lets browsers send cookies and HTTP auth along with requests.
+	// The allowed origin is echoed back instead of "*", as browsers require.
+	// Only origins listed by name are allowed; "*" is ignored, so random sites can't act as the user.
+	AllowCredentials bool
+}
+
+// DefaultCORS is used when Server.CORS is nil. It allows any origin.
+var DefaultCORS = CORS{
+	AllowedOrigins: []string{"*"},
+	AllowedHeaders: []string{"Content-Type"},
+}
+
+func (srv *Server) cors() *CORS {
+	if srv.CORS != nil {
+		return srv.CORS
+	}
+	return &DefaultCORS
+}
+
+// allows reports whether origin may access the server.
+// Requests without an Origin header don't come from browsers, so they're always allowed.
+func (c *CORS) allows(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if (o == "*" && !c.AllowCredentials) || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the CORS headers for r, or returns false if its origin isn't allowed.
+func (c *CORS) apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !c.allows(origin) {
+		return false
+	}
+	h := w.Header()
+	if c.AllowCredentials || !contains(c.AllowedOrigins, "*") {
+		if origin != "" {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		h.Add("Vary", "Origin")
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	if r.Method == "OPTIONS" {
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package bbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodySize is the size limit for incoming commands when Server.MaxBodySize isn't set.
+const DefaultMaxBodySize = 1 << 20
+
+func (srv *Server) maxBodySize() int64 {
+	if srv.MaxBodySize > 0 {
+		return srv.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// fields any command can have, even if its struct doesn't
+var envelopeFields = map[string]bool{
+	"cmd":     true,
+	"session": true,
+	"version": true,
+}
+
+// decode unmarshals a command into v. In strict mode, unknown fields are an error.
+// Errors are *CodeErrors with the "malformed" code.
+func (srv *Server) decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(v); err != nil {
+		return malformed(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &CodeError{Code: CodeMalformed, Message: "malformed command: trailing data after JSON object"}
+	}
+	if srv.Strict {
+		if field := unknownField(data, reflect.TypeOf(v), ""); field != "" {
+			return &CodeError{
+				Code:    CodeMalformed,
+				Message: "malformed command: unknown field " + strconv.Quote(field),
+				Details: map[string]string{"field": field},
+			}
+		}
+	}
+	return nil
+}
+
+// unknownField returns the path of the first field in data that t doesn't have, or "" if there are none.
+func unknownField(data []byte, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(data, &obj) != nil {
+			return ""
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ft, ok := fields[strings.ToLower(k)]
+			if !ok {
+				if path == "" && envelopeFields[k] {
+					continue
+				}
+				return path + k
+			}
+			if f := unknownField(obj[k], ft, path+k+"."); f != "" {
+				return f
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte or json.RawMessage
+			return ""
+		}
+		var arr []json.RawMessage
+		if json.Unmarshal(data, &arr) != nil {
+			return ""
+		}
+		for i, elem := range arr {
+			if f := unknownField(elem, t.Elem(), path+strconv.Itoa(i)+"."); f != "" {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
+// jsonFields maps the lowercased JSON names of t's fields to their types,
+// like encoding/json sees them
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+// decodeCommand reads the "cmd" and "session" fields every command has.
+func decodeCommand(data []byte) (UserCommand, error) {
+	var incoming UserCommand
+	if err := json.Unmarshal(data, &incoming); err != nil {
+		return incoming, malformed(err)
+	}
+	return incoming, nil
+}
+
+// sniffCommand picks out whatever "session" and "version" it can from a command that didn't decode,
+// reading up to the first problem, so even truncated commands give something.
+func sniffCommand(data []byte) (incoming UserCommand) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return
+		}
+		var v interface{}
+		switch key {
+		case "session":
+			v = &incoming.Session
+		case "version":
+			v = &incoming.Version
+		default:
+			v = new(json.RawMessage)
+		}
+		if err := dec.Decode(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func malformed(err error) *CodeError {
+	ce := &CodeError{
+		Code:    CodeMalformed,
+		Message: "malformed command: " + err.Error(),
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		ce.Details = map[string]string{"offset": strconv.FormatInt(syntaxErr.Offset, 10)}
+	case errors.As(err, &typeErr):
+		what := typeErr.Field
+		if what == "" {
+			what = "command"
+		}
+		ce.Message = fmt.Sprintf("malformed command: %s should be %s, not %s", what, jsonType(typeErr.Type), typeErr.Value)
+		ce.Details = map[string]string{
+			"field":  typeErr.Field,
+			"offset": strconv.FormatInt(typeErr.Offset, 10),
+		}
+	case err == io.EOF:
+		ce.Message = "malformed command: empty"
+	}
+	return ce
+}
+
+// jsonType describes t the way a client would
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Bool:
+		return "bool"
+	case reflect.String:
+		return "string"
+	case reflect.Ptr:
+		return jsonType(t.Elem())
+	}
+	return "number"
+}
+
+func tooLarge(limit int64) *CodeError {
+	return &CodeError{
+		Code:    CodeTooLarge,
+		Message: fmt.Sprintf("command too large (limit is %d bytes)", limit),
+		Details: map[string]string{"limit": strconv.FormatInt(limit, 10)},
+	}
+}
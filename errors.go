@@ -0,0 +1,108 @@
+package bbs
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// machine-readable error codes, for ErrorMessage.Code
+const (
+	CodeSessionExpired     = "session_expired"
+	CodeLoginFailed        = "login_failed"
+	CodeNotFound           = "not_found"
+	CodeForbidden          = "forbidden"
+	CodeRateLimited        = "rate_limited"
+	CodeClosedThread       = "closed_thread"
+	CodeValidation         = "validation"
+	CodeMalformed          = "malformed"
+	CodeTooLarge           = "too_large"
+	CodeUnsupported        = "unsupported"
+	CodeUnknownCommand     = "unknown_command"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeInsecure           = "insecure"
+	CodeSpam               = "spam"
+	CodeChallenge          = "challenge"
+	CodeHeld               = "held" // never sent; see Held
+)
+
+// CodeError is an error with a code for clients to act on.
+// Backends can return one (or an error wrapping one) from Get, Reply, etc.
+// and the server will send its code, details, and retry time along with the error message.
+type CodeError struct {
+	Code       string
+	Message    string
+	Details    map[string]string
+	RetryAfter time.Duration
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
+}
+
+// Is makes errors.Is match any CodeError with the same code,
+// so errors.Is(err, ErrNotFound) is true for every not-found error.
+func (e *CodeError) Is(target error) bool {
+	t, ok := target.(*CodeError)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrSessionExpired = &CodeError{Code: CodeSessionExpired, Message: "bad session"}
+	ErrNotFound       = &CodeError{Code: CodeNotFound, Message: "not found"}
+	ErrForbidden      = &CodeError{Code: CodeForbidden, Message: "forbidden"}
+	ErrRateLimited    = &CodeError{Code: CodeRateLimited, Message: "slow down"}
+	ErrClosedThread   = &CodeError{Code: CodeClosedThread, Message: "thread is closed"}
+	ErrValidation     = &CodeError{Code: CodeValidation, Message: "invalid input"}
+)
+
+// NewError returns an error with the given code and message.
+func NewError(code, msg string) *CodeError {
+	return &CodeError{Code: code, Message: msg}
+}
+
+// RateLimited returns an error asking the client to try again after d.
+func RateLimited(d time.Duration) *CodeError {
+	return &CodeError{Code: CodeRateLimited, Message: "slow down", RetryAfter: d}
+}
+
+// errorFor converts an error from a backend into an "error" message.
+// The message text is always err's own, even if the code comes from an error it wraps.
+func errorFor(wrt string, err error) ErrorMessage {
+	msg := Error(wrt, err.Error())
+	var ce *CodeError
+	if errors.As(err, &ce) {
+		msg.Code = ce.Code
+		msg.Details = ce.Details
+		msg.RetryAfter = int((ce.RetryAfter + time.Second - 1) / time.Second)
+	}
+	return msg
+}
+
+// httpStatus picks an HTTP status code for a reply, for Server.HTTPStatus.
+func httpStatus(result interface{}) int {
+	var msg ErrorMessage
+	switch m := result.(type) {
+	case ErrorMessage:
+		msg = m
+	case *ErrorMessage:
+		msg = *m
+	default:
+		return http.StatusOK
+	}
+	switch msg.Code {
+	case CodeSessionExpired, CodeLoginFailed:
+		return http.StatusUnauthorized
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeForbidden, CodeClosedThread, CodeInsecure, CodeSpam, CodeChallenge:
+		return http.StatusForbidden
+	case CodeRateLimited:
+		return http.StatusTooManyRequests
+	case CodeValidation, CodeMalformed, CodeUnsupported, CodeUnknownCommand, CodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,127 @@
+package bbs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// Content is a post, reply or registration about to go to the backend, for filters to look at.
+type Content struct {
+	Command   string // "post", "reply" or "register"
+	UserID    string // empty for guests and registrations
+	Addr      string // the client's IP address
+	Title     string // for "post"
+	Text      string // body of a "post" or "reply"
+	To        string // thread ID for "reply"
+	Username  string // for "register"
+	Email     string // for "register"
+	Challenge string // answer to the server's challenge, if any
+	Data      []byte // the whole command without its password and session, for replaying it later
+}
+
+// Filter checks content before it reaches the backend, to keep out spam.
+// Returning nil lets it through. Returning an error rejects it, and the client gets the error;
+// use a CodeError (like NewError(CodeSpam, ...)) to give it a code. Returning Held(...) sends it to moderation.
+type Filter interface {
+	Check(ctx context.Context, c *Content) error
+}
+
+// FilterFunc adapts a function to a Filter.
+type FilterFunc func(ctx context.Context, c *Content) error
+
+func (f FilterFunc) Check(ctx context.Context, c *Content) error {
+	return f(ctx, c)
+}
+
+// Challenger can be implemented by filters that want clients to solve something first,
+// like a proof of work or captcha. The server describes it in "hello".
+type Challenger interface {
+	Challenge() ChallengeInfo
+}
+
+// Recorder can be implemented by filters that remember what was posted, like duplicate checks.
+// Accepted is called after content passed every filter and the backend took it.
+type Recorder interface {
+	Accepted(ctx context.Context, c *Content)
+}
+
+// ModerationQueue keeps content that filters held back, for a moderator to look at.
+type ModerationQueue interface {
+	Hold(ctx context.Context, c Content, reason string) error
+}
+
+// ErrHeld matches the errors made by Held.
+var ErrHeld = NewError(CodeHeld, "held for moderation")
+
+// Held returns an error telling the server to send content to the moderation queue instead of the backend.
+func Held(reason string) error {
+	return NewError(CodeHeld, reason)
+}
+
+// screen runs the filters over c. It returns the reply to send instead of running the command, if any.
+func (srv *Server) screen(ctx context.Context, c *Content, sesh *Session) interface{} {
+	if len(srv.Filters) == 0 {
+		return nil
+	}
+	if sesh != nil {
+		c.UserID = sesh.UserID
+	}
+	c.Addr = RemoteAddr(ctx)
+	c.Data = withoutSecrets(c.Data)
+	for _, f := range srv.Filters {
+		err := f.Check(ctx, c)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrHeld) {
+			return errorFor(c.Command, err)
+		}
+		if srv.Moderation == nil {
+			log.Printf("Warning: a filter held %s content, but there's no moderation queue", c.Command)
+			return ErrorCode(c.Command, CodeSpam, err.Error())
+		}
+		if err := srv.Moderation.Hold(ctx, *c, err.Error()); err != nil {
+			return errorFor(c.Command, err)
+		}
+		return OKMessage{Command: "ok", ReplyTo: c.Command, Result: "held"}
+	}
+	return nil
+}
+
+// accepted tells the filters that c made it to the backend
+func (srv *Server) accepted(ctx context.Context, c *Content) {
+	for _, f := range srv.Filters {
+		if r, ok := f.(Recorder); ok {
+			r.Accepted(ctx, c)
+		}
+	}
+}
+
+// withoutSecrets removes the password and session token from a command,
+// so they don't end up in moderation queues
+func withoutSecrets(data []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	delete(fields, "password")
+	delete(fields, "session")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// challenge describes the first challenge the filters want, if any
+func (srv *Server) challenge() *ChallengeInfo {
+	for _, f := range srv.Filters {
+		if c, ok := f.(Challenger); ok {
+			info := c.Challenge()
+			return &info
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package bbs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginGuard slows down password guessing by tracking failed logins per username and per IP address.
+// After a few failures, further attempts have to wait, twice as long after every failure.
+// After many failures, the username or address is locked out for a while, or until Unlock is called.
+// It works the same no matter what the backend's LogIn does.
+// Zero settings get the same defaults as NewLoginGuard, except Lockout.
+type LoginGuard struct {
+	Backoff         int           // failures before attempts have to wait
+	BaseDelay       time.Duration // wait after the first failure over Backoff, doubling after each one
+	MaxDelay        time.Duration // longest wait
+	Lockout         int           // failures before a lockout, 0 for never
+	LockoutDuration time.Duration
+	Forget          time.Duration // failures older than this are forgotten
+
+	mu        sync.Mutex
+	users     map[string]*failures
+	addrs     map[string]*failures
+	lastSweep time.Time
+}
+
+// how often to forget old failures
+const loginGuardSweep = time.Minute
+
+// LoginNotifier can be implemented by BBS backends that want to hear about brute-force attempts,
+// for example to alert admins. The username or address may be empty.
+type LoginNotifier interface {
+	LoginFailed(username, addr string, count int)
+	LockedOut(username, addr string, until time.Time)
+}
+
+type failures struct {
+	count   int
+	pending int // attempts that haven't finished yet
+	last    time.Time
+	until   time.Time // can't try again before this
+	locked  bool
+}
+
+// NewLoginGuard returns a LoginGuard with sensible defaults.
+func NewLoginGuard() *LoginGuard {
+	g := &LoginGuard{Lockout: 20}
+	g.init()
+	return g
+}
+
+// init fills in zero settings and makes the maps, for guards that didn't come from NewLoginGuard
+func (g *LoginGuard) init() {
+	if g.users != nil {
+		return
+	}
+	if g.Backoff == 0 {
+		g.Backoff = 3
+	}
+	if g.BaseDelay == 0 {
+		g.BaseDelay = time.Second
+	}
+	if g.MaxDelay == 0 {
+		g.MaxDelay = 5 * time.Minute
+	}
+	if g.LockoutDuration == 0 {
+		g.LockoutDuration = time.Hour
+	}
+	if g.Forget == 0 {
+		g.Forget = 24 * time.Hour
+	}
+	g.users = make(map[string]*failures)
+	g.addrs = make(map[string]*failures)
+	g.lastSweep = time.Now()
+}
+
+// Check returns a "rate_limited" error if username or addr has to wait before trying again.
+// Use Attempt instead when about to try a login, so parallel guesses can't all get through.
+func (g *LoginGuard) Check(username, addr string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	now := time.Now()
+	g.maybeSweep(now)
+	return g.check(g.records(username, addr, false), now)
+}
+
+// Attempt is like Check, but also reserves the attempt until done is called with how it went.
+// Until then, it counts as a failure for anyone else trying the same username or address.
+func (g *LoginGuard) Attempt(username, addr string) (done func(b BBS, ok bool), err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	now := time.Now()
+	g.maybeSweep(now)
+	fs := g.records(username, addr, true)
+	if err := g.check(fs, now); err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		f.pending++
+	}
+	return func(b BBS, ok bool) {
+		g.mu.Lock()
+		for _, f := range g.records(username, addr, true) {
+			if f.pending > 0 {
+				f.pending--
+			}
+		}
+		g.mu.Unlock()
+		if ok {
+			g.Succeed(username)
+		} else {
+			g.Fail(b, username, addr)
+		}
+	}, nil
+}
+
+// check returns an error if any of fs has to wait, counting unfinished attempts as failures
+func (g *LoginGuard) check(fs []*failures, now time.Time) error {
+	var wait time.Duration
+	locked := false
+	for _, f := range fs {
+		d := f.until.Sub(now)
+		if f.pending > 0 && f.count+f.pending >= g.Backoff && d < g.BaseDelay {
+			// if the ones in flight fail, this one would have to wait
+			d = g.BaseDelay
+		}
+		if d > wait {
+			wait = d
+			locked = f.locked
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	err := RateLimited(wait)
+	if locked {
+		err.Message = "Too many failed logins, try again later"
+		err.Details = map[string]string{"reason": "locked"}
+	} else {
+		err.Message = "Too many failed logins, slow down"
+		err.Details = map[string]string{"reason": "backoff"}
+	}
+	return err
+}
+
+// Fail records a failed login, notifying b if it's a LoginNotifier.
+func (g *LoginGuard) Fail(b BBS, username, addr string) {
+	g.mu.Lock()
+	g.init()
+	now := time.Now()
+	g.maybeSweep(now)
+	var count int
+	var lockedUntil time.Time
+	for _, f := range g.records(username, addr, true) {
+		if now.Sub(f.last) > g.Forget || (f.locked && now.After(f.until)) {
+			*f = failures{pending: f.pending}
+		}
+		f.count++
+		f.last = now
+		switch {
+		case g.Lockout > 0 && f.count >= g.Lockout:
+			if !f.locked {
+				f.locked = true
+				f.until = now.Add(g.LockoutDuration)
+				lockedUntil = f.until
+			}
+		case f.count >= g.Backoff:
+			f.until = now.Add(g.delay(f.count - g.Backoff))
+		}
+		if f.count > count {
+			count = f.count
+		}
+	}
+	g.mu.Unlock()
+
+	if n, ok := b.(LoginNotifier); ok {
+		n.LoginFailed(username, addr, count)
+		if !lockedUntil.IsZero() {
+			n.LockedOut(username, addr, lockedUntil)
+		}
+	}
+}
+
+// Succeed forgets the failures for username.
+// Failures from the address are kept, so one working account doesn't help guess others.
+func (g *LoginGuard) Succeed(username string) {
+	g.Unlock(username)
+}
+
+// Unlock forgets the failures and lifts any lockout for username.
+func (g *LoginGuard) Unlock(username string) {
+	g.mu.Lock()
+	delete(g.users, strings.ToLower(username))
+	g.mu.Unlock()
+}
+
+// UnlockAddr forgets the failures and lifts any lockout for an IP address.
+func (g *LoginGuard) UnlockAddr(addr string) {
+	g.mu.Lock()
+	delete(g.addrs, addr)
+	g.mu.Unlock()
+}
+
+// Sweep forgets old failures.
+// Check and Fail already do this every minute, so there's usually no need to call it.
+func (g *LoginGuard) Sweep() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	g.sweep(time.Now())
+}
+
+func (g *LoginGuard) maybeSweep(now time.Time) {
+	if now.Sub(g.lastSweep) > loginGuardSweep {
+		g.sweep(now)
+	}
+}
+
+func (g *LoginGuard) sweep(now time.Time) {
+	for _, m := range []map[string]*failures{g.users, g.addrs} {
+		for k, f := range m {
+			if f.pending == 0 && now.Sub(f.last) > g.Forget && now.After(f.until) {
+				delete(m, k)
+			}
+		}
+	}
+	g.lastSweep = now
+}
+
+func (g *LoginGuard) delay(n int) time.Duration {
+	d := g.BaseDelay
+	for i := 0; i < n && d < g.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.MaxDelay {
+		d = g.MaxDelay
+	}
+	return d
+}
+
+// records returns the failure records for username and addr, creating them if create is set
+func (g *LoginGuard) records(username, addr string, create bool) []*failures {
+	var fs []*failures
+	get := func(m map[string]*failures, key string) {
+		if key == "" {
+			return
+		}
+		f := m[key]
+		if f == nil && create {
+			f = &failures{}
+			m[key] = f
+		}
+		if f != nil {
+			fs = append(fs, f)
+		}
+	}
+	get(g.users, strings.ToLower(username))
+	get(g.addrs, addr)
+	return fs
+}
+
+// checkLogin returns an error if the guard won't let this login through
+func (sh *SessionHandler) checkLogin(ctx context.Context, m LoginCommand) error {
+	if sh.Guard == nil {
+		return nil
+	}
+	return sh.Guard.Check(m.Username, RemoteAddr(ctx))
+}
+
+// guardedLogIn logs in to b, unless the guard says to wait, and records the outcome
+func (sh *SessionHandler) guardedLogIn(ctx context.Context, b BBS, m LoginCommand) (userID string, ok bool) {
+	if sh.Guard == nil {
+		return authenticate(ctx, b, m)
+	}
+	done, err := sh.Guard.Attempt(m.Username, RemoteAddr(ctx))
+	if err != nil {
+		return "", false
+	}
+	userID, ok = authenticate(ctx, b, m)
+	done(b, ok)
+	if !ok {
+		return "", false
+	}
+	return userID, true
+}
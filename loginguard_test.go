@@ -0,0 +1,62 @@
+package bbs
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardLiteral(t *testing.T) {
+	g := &LoginGuard{Backoff: 2}
+	for i := 0; i < 2; i++ {
+		if err := g.Check("alice", "1.2.3.4"); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		g.Fail(nil, "alice", "1.2.3.4")
+	}
+	if g.Check("alice", "") == nil {
+		t.Error("username isn't backing off")
+	}
+	if g.Check("", "1.2.3.4") == nil {
+		t.Error("address isn't backing off")
+	}
+	if g.Check("bob", "5.6.7.8") != nil {
+		t.Error("someone else is backing off")
+	}
+	g.Succeed("alice")
+	if g.Check("alice", "") != nil {
+		t.Error("still backing off after logging in")
+	}
+}
+
+func TestLoginGuardParallel(t *testing.T) {
+	g := &LoginGuard{Backoff: 3, BaseDelay: time.Minute}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed := 0
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			done, err := g.Attempt("alice", "1.2.3.4")
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			allowed++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond) // a slow password check
+			done(nil, false)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("%d parallel guesses got through, want 3", allowed)
+	}
+	if g.Check("alice", "1.2.3.4") == nil {
+		t.Error("not backing off after the guesses failed")
+	}
+}
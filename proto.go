@@ -1,6 +1,9 @@
 package bbs
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 //This has all the structs for various commands
 
@@ -11,9 +14,10 @@ type BBSCommand struct {
 type UserCommand struct {
 	Command string `json:"cmd"`
 	Session string `json:"session"`
+	Version int    `json:"version,omitempty"` //protocol version, for clients without a session
 }
 
-//From start to end inclusive, starting from 1.
+// From start to end inclusive, starting from 1.
 type Range struct {
 	Start int `json:"start"`
 	End   int `json:"end"`
@@ -39,23 +43,41 @@ type Listener interface {
 	Send(interface{})
 }
 
+// "hello" command (client -> server)
+type HelloCommand struct {
+	Command    string `json:"cmd"`
+	Session    string `json:"session,omitempty"`
+	Version    int    `json:"version,omitempty"`     //newest protocol version the client speaks
+	MinVersion int    `json:"min_version,omitempty"` //oldest protocol version the client speaks
+}
+
 // "hello" message (server -> client)
 type HelloMessage struct {
-	Command         string     `json:"cmd"`
-	Name            string     `json:"name"`
-	ProtocolVersion int        `json:"version"`
-	Description     string     `json:"desc"`
-	SecureURL       string     `json:"secure,omitempty"` //https URL, if any
-	Options         []string   `json:"options,omitempty"`
-	Access          AccessInfo `json:"access"`
-	Formats         []string   `json:"format"` //formats the server accepts, the first one should be the primary one
-	Lists           []string   `json:"lists"`
-	ServerVersion   string     `json:"server"`
-	IconURL         string     `json:"icon"`
-	// for option "range"
-	DefaultRange Range `json:"default_range,omitempty"`
-	// for option "realtime"
-	RealtimeURL string `json:"realtime"`
+	Command         string         `json:"cmd"`
+	Name            string         `json:"name"`
+	ProtocolVersion int            `json:"version"`               //the version picked for this client
+	MinVersion      int            `json:"min_version,omitempty"` //oldest version the server speaks
+	MaxVersion      int            `json:"max_version,omitempty"` //newest version the server speaks
+	Description     string         `json:"desc"`
+	SecureURL       string         `json:"secure,omitempty"` //https URL, if any
+	Options         []string       `json:"options,omitempty"`
+	Access          AccessInfo     `json:"access"`
+	Formats         []string       `json:"format"` //formats the server accepts, the first one should be the primary one
+	Lists           []string       `json:"lists"`
+	LoginMethods    []string       `json:"login,omitempty"` //how users can log in, "password" if omitted
+	ServerVersion   string         `json:"server"`
+	IconURL         string         `json:"icon"`
+	DefaultRange    Range          `json:"default_range,omitempty" option:"range"`
+	RealtimeURL     string         `json:"realtime" option:"realtime"`
+	EventsURL       string         `json:"events,omitempty" option:"realtime"` //Server-Sent Events URL, if any
+	Challenge       *ChallengeInfo `json:"challenge,omitempty"`                //what to solve before posting, if anything
+}
+
+// describes a challenge for the "challenge" field of "post", "reply" and "register"
+type ChallengeInfo struct {
+	Type string `json:"type"`           //"pow" or "captcha"
+	Bits int    `json:"bits,omitempty"` //for "pow", leading zero bits needed
+	URL  string `json:"url,omitempty"`  //for "captcha", where to get one
 }
 
 // guest commands are commands you can use without logging on (e.g. "list", "get")
@@ -67,13 +89,16 @@ type AccessInfo struct {
 
 // "error" message (server -> client)
 type ErrorMessage struct {
-	Command string `json:"cmd"`
-	ReplyTo string `json:"wrt"`
-	Error   string `json:"error"`
+	Command    string            `json:"cmd"`
+	ReplyTo    string            `json:"wrt"`
+	Error      string            `json:"error"`
+	Code       string            `json:"code,omitempty"`        //machine-readable, like "not_found"
+	Details    map[string]string `json:"details,omitempty"`     //extra info, depends on code
+	RetryAfter int               `json:"retry_after,omitempty"` //seconds to wait before trying again
 }
 
 // session expired or invalid? use this
-var SessionErrorMessage ErrorMessage = Error("session", "bad session")
+var SessionErrorMessage ErrorMessage = ErrorCode("session", CodeSessionExpired, "bad session")
 
 // "ok" message (server -> client)
 type OKMessage struct {
@@ -82,12 +107,25 @@ type OKMessage struct {
 	Result  string `json:"result,omitempty"`
 }
 
+// login methods for "hello" and "login"
+const (
+	LoginPassword  = "password"  //username and password
+	LoginUsername  = "username"  //just a username, like a handle on an anonymous board
+	LoginAnonymous = "anonymous" //nothing at all
+	LoginToken     = "token"     //an API token, for bots
+	LoginCode      = "code"      //username and a one-time code sent some other way
+)
+
 // "login" command (client -> server)
 type LoginCommand struct {
 	Command         string `json:"cmd"`
+	Method          string `json:"method,omitempty"` //"password" if empty
 	Username        string `json:"username"`
 	Password        string `json:"password"`
+	Token           string `json:"token,omitempty"` //for "token"
+	Code            string `json:"code,omitempty"`  //for "code"
 	ProtocolVersion int    `json:"version"`
+	MinVersion      int    `json:"min_version,omitempty"`
 
 	// for "re-logins" only
 	Session string `json:"session,omitempty"`
@@ -106,12 +144,47 @@ type LogoutCommand struct {
 	Session string `json:"session"`
 }
 
+// "sessions" command (client -> server)
+// Lists the sessions the user is logged in with.
+type SessionsCommand struct {
+	Command string `json:"cmd"`
+	Session string `json:"session"`
+}
+
+// "sessions" message (server -> client)
+type SessionsMessage struct {
+	Command  string           `json:"cmd"`
+	Sessions []SessionListing `json:"sessions"`
+}
+
+// format for sessions in "sessions"
+type SessionListing struct {
+	ID          string `json:"id"` //not the session token, just a name for it
+	Created     string `json:"created,omitempty"`
+	LastActive  string `json:"last_active,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	Connections int    `json:"connections,omitempty"` //open websocket and SSE connections
+	Current     bool   `json:"current,omitempty"`     //the session this command was sent with
+}
+
+// "revoke" command (client -> server)
+// Logs out another of the user's sessions, or all of them but this one.
+type RevokeCommand struct {
+	Command string `json:"cmd"`
+	Session string `json:"session"`
+	ID      string `json:"id,omitempty"`     //from "sessions"
+	Others  bool   `json:"others,omitempty"` //log out every other session
+}
+
 // "register" command (client -> server)
 type RegisterCommand struct {
-	Command  string `json:"cmd"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email,omitempty"`
+	Command   string `json:"cmd"`
+	Session   string `json:"session,omitempty"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Email     string `json:"email,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
 }
 
 // "get" command (client -> server)
@@ -119,8 +192,8 @@ type GetCommand struct {
 	Command  string `json:"cmd"`
 	Session  string `json:"session,omitempty"`
 	ThreadID string `json:"id"`
-	Range    Range  `json:"range"`            //option: "range"
-	Filter   string `json:"filter,omitempty"` //option: "filter"
+	Range    Range  `json:"range" option:"range"`
+	Filter   string `json:"filter,omitempty" option:"filter"`
 	Format   string `json:"format,omitempty"`
 	Token    string `json:"token,omitempty"`
 }
@@ -136,22 +209,24 @@ type ListCommand struct {
 
 // "reply" command (client -> server)
 type ReplyCommand struct {
-	Command string `json:"cmd"`
-	Session string `json:"session,omitempty"`
-	To      string `json:"to"`
-	Text    string `json:"body"`
-	Format  string `json:"format,omitempty"`
+	Command   string `json:"cmd"`
+	Session   string `json:"session,omitempty"`
+	To        string `json:"to"`
+	Text      string `json:"body"`
+	Format    string `json:"format,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
 }
 
 // "post" command (client -> server)
 type PostCommand struct {
-	Command string   `json:"cmd"`
-	Session string   `json:"session,omitempty"`
-	Title   string   `json:"title"`
-	Text    string   `json:"body"`
-	Format  string   `json:"format,omitempty"`
-	Board   string   `json:"board,omitempty"` //option: "boards"
-	Tags    []string `json:"tags,omitempty"`  //option: "tags"
+	Command   string   `json:"cmd"`
+	Session   string   `json:"session,omitempty"`
+	Title     string   `json:"title"`
+	Text      string   `json:"body"`
+	Format    string   `json:"format,omitempty"`
+	Board     string   `json:"board,omitempty" option:"boards"`
+	Tags      []string `json:"tags,omitempty" option:"tags"`
+	Challenge string   `json:"challenge,omitempty"`
 }
 
 // "msg" message (server -> client) [response to "get"]
@@ -161,9 +236,9 @@ type ThreadMessage struct {
 	Title     string    `json:"title,omitempty"`
 	Range     Range     `json:"range,omitempty"`
 	Closed    bool      `json:"closed,omitempty"`
-	Filter    string    `json:"filter,omitempty"` //option: "filter"
-	Board     string    `json:"board,omitempty"`  //option: "boards"
-	Tags      []string  `json:"tags,omitempty"`   //option: "tags"
+	Filter    string    `json:"filter,omitempty" option:"filter"`
+	Board     string    `json:"board,omitempty" option:"boards"`
+	Tags      []string  `json:"tags,omitempty" option:"tags"`
 	Format    string    `json:"format,omitempty"`
 	Messages  []Message `json:"messages"`
 	Total     int       `json:"total,omitempty"`
@@ -186,11 +261,11 @@ type Message struct {
 	Date               string `json:"date,omitempty"`
 	Text               string `json:"body"`
 	Signature          string `json:"sig,omitempty"`
-	AuthorTitle        string `json:"user_title,omitempty"`   //option: "usertitles"
-	AvatarURL          string `json:"avatar,omitempty"`       //option: "avatars"
-	AvatarThumbnailURL string `json:"avatar_thumb,omitempty"` //option: "avatars"
-	PictureURL         string `json:"img,omitempty"`          //option: "imageboard"
-	ThumbnailURL       string `json:"thumb,omitempty"`        //option: "imageboard"
+	AuthorTitle        string `json:"user_title,omitempty" option:"usertitles"`
+	AvatarURL          string `json:"avatar,omitempty" option:"avatars"`
+	AvatarThumbnailURL string `json:"avatar_thumb,omitempty" option:"avatars"`
+	PictureURL         string `json:"img,omitempty" option:"imageboard"`
+	ThumbnailURL       string `json:"thumb,omitempty" option:"imageboard"`
 }
 
 type TypedMessage struct {
@@ -212,7 +287,7 @@ type BoardListMessage struct {
 	Command string         `json:"cmd"`
 	Type    string         `json:"type"`
 	Query   string         `json:"query,omitempty"`
-	Boards  []BoardListing `json:"boards"`
+	Boards  []BoardListing `json:"boards" option:"boards"`
 }
 
 type BookmarkListMessage struct {
@@ -221,6 +296,14 @@ type BookmarkListMessage struct {
 	Bookmarks []Bookmark `json:"bookmarks"`
 }
 
+// "list" message where type = "tag" (server -> client)
+type TagListMessage struct {
+	Command string       `json:"cmd"`
+	Type    string       `json:"type"`
+	Query   string       `json:"query,omitempty"`
+	Tags    []TagListing `json:"tags" option:"tags"`
+}
+
 type Bookmark struct {
 	ID    string `json:"id,omitempty"`
 	Name  string `json:"name"`
@@ -229,10 +312,64 @@ type Bookmark struct {
 
 type ListenCommand struct {
 	Command string `json:"cmd"`
+	Session string `json:"session,omitempty"`
 	Type    string `json:"type"`
 	ID      string `json:"id"`
 }
 
+// "batch" command (client -> server)
+// Runs several commands in order, with the same session.
+type BatchCommand struct {
+	Command     string            `json:"cmd"`
+	Session     string            `json:"session,omitempty"`
+	Commands    []json.RawMessage `json:"commands"`
+	StopOnError bool              `json:"stop_on_error,omitempty"`
+}
+
+// "batch" message (server -> client)
+// Results has the reply to each command, in order. With stop_on_error, it ends at the first error.
+type BatchMessage struct {
+	Command string        `json:"cmd"`
+	Results []interface{} `json:"results"`
+}
+
+// "resume" command (client -> server, websocket only)
+// Reattaches a new websocket to a logged-in session, replaying the realtime messages sent after Seq.
+type ResumeCommand struct {
+	Command string `json:"cmd"`
+	Session string `json:"session"`
+	Seq     uint64 `json:"seq"` //the last "seq" the client saw
+}
+
+// "resume" message (server -> client)
+type ResumeMessage struct {
+	Command  string `json:"cmd"`
+	Username string `json:"username,omitempty"`
+	Session  string `json:"session"`
+	Seq      uint64 `json:"seq"`
+	Resync   bool   `json:"resync,omitempty"` //messages were lost, reload everything
+}
+
+// realtime messages were lost, and the client should reload whatever it's showing
+var ResyncMessage = BBSCommand{"resync"}
+
+// "poll" command (client -> server)
+// Waits for realtime messages, for clients without websockets or SSE.
+type PollCommand struct {
+	Command string `json:"cmd"`
+	Session string `json:"session"`
+	Cursor  uint64 `json:"cursor"`            //"cursor" from the last poll, or 0 at first
+	Timeout int    `json:"timeout,omitempty"` //seconds to wait for messages
+}
+
+// "poll" message (server -> client)
+type PollMessage struct {
+	Command  string        `json:"cmd"`
+	Cursor   uint64        `json:"cursor"`
+	Messages []interface{} `json:"messages"`
+	Resync   bool          `json:"resync,omitempty"` //some messages were lost, reload everything
+}
+
 // format for threads in "list"
 type ThreadListing struct {
 	ID           string   `json:"id"`
@@ -244,9 +381,9 @@ type ThreadListing struct {
 	UnreadPosts  int      `json:"unread_posts,omitempty"`
 	Sticky       bool     `json:"sticky,omitempty"` //a sticky (aka pinned) topic
 	Closed       bool     `json:"closed,omitempty"` //a closed (aka locked) topic
-	Tags         []string `json:"tags,omitempty"`   //option: "tags"
-	PictureURL   string   `json:"img,omitempty"`    //option: "imageboard"
-	ThumbnailURL string   `json:"thumb,omitempty"`  //option: "imageboard"
+	Tags         []string `json:"tags,omitempty" option:"tags"`
+	PictureURL   string   `json:"img,omitempty" option:"imageboard"`
+	ThumbnailURL string   `json:"thumb,omitempty" option:"imageboard"`
 }
 
 // format for boards in "list"
@@ -258,3 +395,12 @@ type BoardListing struct {
 	PostCount   int    `json:"posts,omitempty"`
 	Date        string `json:"date,omitempty"`
 }
+
+// format for tags in "list"
+type TagListing struct {
+	Name        string   `json:"name"`
+	Description string   `json:"desc,omitempty"`
+	ThreadCount int      `json:"threads,omitempty"`
+	Related     []string `json:"related,omitempty"`    //tags that often appear alongside this one
+	Restricted  bool     `json:"restricted,omitempty"` //only some users may post with this tag
+}
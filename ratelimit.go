@@ -0,0 +1,141 @@
+package bbs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: up to Burst commands at once, refilling at Rate commands per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns a Limit of one command per interval, with the given burst.
+func Every(interval time.Duration, burst int) Limit {
+	return Limit{
+		Rate:  float64(time.Second) / float64(interval),
+		Burst: burst,
+	}
+}
+
+// DefaultLimits are strict on logging in, registering and posting, and loose on reading.
+var DefaultLimits = map[string]Limit{
+	"login":    Every(10*time.Second, 5),
+	"register": Every(time.Minute, 3),
+	"post":     Every(30*time.Second, 2),
+	"reply":    Every(5*time.Second, 5),
+	"*":        Every(100*time.Millisecond, 50),
+}
+
+// how often to forget idle buckets
+const rateLimitSweep = time.Minute
+
+// RateLimiter limits how fast clients can send commands, per command.
+// Each command counts against both the user (for logged in sessions) and the IP address.
+// Use it with Server.Use(rl.Middleware); it works for HTTP and websocket clients alike.
+// Behind a load balancer or reverse proxy, set Server.TrustedProxies so that addresses
+// come from X-Forwarded-For; otherwise every client shares the proxy's limit.
+type RateLimiter struct {
+	limits map[string]Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when it will have refilled to Burst
+}
+
+// NewRateLimiter returns a RateLimiter with limits by command name.
+// The "*" entry applies to commands without their own entry; without it, they're unlimited.
+func NewRateLimiter(limits map[string]Limit) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware rejects commands over the limit with a "rate_limited" error.
+func (rl *RateLimiter) Middleware(next Handler) Handler {
+	return func(ctx context.Context, cmd BBSCommand, data []byte, sesh *Session) interface{} {
+		var keys []string
+		if sesh != nil && sesh.UserID != "" {
+			keys = append(keys, "user:"+sesh.UserID+":"+cmd.Command)
+		}
+		if addr := RemoteAddr(ctx); addr != "" {
+			keys = append(keys, "ip:"+addr+":"+cmd.Command)
+		}
+		if wait := rl.Allow(cmd.Command, keys...); wait > 0 {
+			return errorFor(cmd.Command, RateLimited(wait))
+		}
+		return next(ctx, cmd, data, sesh)
+	}
+}
+
+// Allow takes a token from the buckets for each key, using the limit for cmd.
+// If any of them is empty, it takes nothing and returns how long to wait.
+func (rl *RateLimiter) Allow(cmd string, keys ...string) time.Duration {
+	limit, ok := rl.limits[cmd]
+	if !ok {
+		limit, ok = rl.limits["*"]
+	}
+	if !ok || len(keys) == 0 {
+		return 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > rateLimitSweep {
+		rl.sweep(now)
+	}
+	var wait time.Duration
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		b := rl.buckets[key]
+		if b == nil {
+			b = &bucket{tokens: float64(limit.Burst), last: now}
+			rl.buckets[key] = b
+		}
+		b.refill(limit, now)
+		if b.tokens < 1 {
+			need := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			if need > wait {
+				wait = need
+			}
+		}
+		buckets[i] = b
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+		b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+	}
+	return 0
+}
+
+func (b *bucket) refill(limit Limit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.last = now
+}
+
+// sweep forgets buckets that have been idle long enough to be full again
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if !now.Before(b.full) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
@@ -0,0 +1,148 @@
+package bbs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// how many realtime events each session keeps for clients catching up
+const eventLogSize = 100
+
+// how long "poll" waits for messages by default, and at most
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// event is a realtime message with its sequence number.
+type event struct {
+	Seq uint64
+	Msg interface{}
+}
+
+// eventLog is what a session's backend sends realtime messages to.
+// It numbers realtime messages and keeps the latest few around,
+// so clients can get them over websockets, SSE, or polling, and catch up after reconnecting.
+type eventLog struct {
+	mu     sync.Mutex
+	events []event
+	seq    uint64
+	wake   chan struct{} // closed when new events arrive
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		wake: make(chan struct{}),
+	}
+}
+
+func (l *eventLog) Send(msg interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.events = append(l.events, event{l.seq, msg})
+	if len(l.events) > eventLogSize {
+		n := copy(l.events, l.events[len(l.events)-eventLogSize:])
+		l.events = l.events[:n]
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// since returns the events after seq.
+// ok is false if some of them were already dropped, or if seq is from the future
+// (the session was recreated), and the client should start over.
+func (l *eventLog) since(seq uint64) (evs []event, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq > l.seq {
+		return nil, false
+	}
+	for i, ev := range l.events {
+		if ev.Seq > seq {
+			return append([]event(nil), l.events[i:]...), ev.Seq == seq+1
+		}
+	}
+	return nil, true
+}
+
+// wait returns the latest sequence number, and a channel that is closed when a newer event arrives.
+func (l *eventLog) wait() (uint64, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.wake
+}
+
+// events returns the session's event log, connecting the session's backend to it if needed.
+func (srv *Server) events(sesh *Session) *eventLog {
+	sesh.mu.Lock()
+	log := sesh.events
+	sesh.mu.Unlock()
+	if log != nil {
+		return log
+	}
+	// connecting uses the backend, which another connection might be running a command on
+	sesh.backend.Lock()
+	defer sesh.backend.Unlock()
+	return srv.eventsLocked(sesh)
+}
+
+// eventsLocked is events for callers already holding sesh.backend
+func (srv *Server) eventsLocked(sesh *Session) *eventLog {
+	sesh.mu.Lock()
+	defer sesh.mu.Unlock()
+	if sesh.events == nil {
+		sesh.events = newEventLog()
+		if r, ok := sesh.BBS.(Realtime); ok {
+			r.Connect(sesh.events)
+		}
+	}
+	return sesh.events
+}
+
+// poll waits for events after m.Cursor, until some arrive or the timeout passes.
+func (srv *Server) poll(ctx context.Context, sesh *Session, m PollCommand) (PollMessage, error) {
+	log := srv.events(sesh)
+	timeout := defaultPollTimeout
+	if m.Timeout > 0 {
+		timeout = time.Duration(m.Timeout) * time.Second
+	}
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	msg := PollMessage{
+		Command:  "poll",
+		Cursor:   m.Cursor,
+		Messages: []interface{}{},
+	}
+	if msg.Cursor == 0 {
+		// first poll: only new messages, like a new websocket or event stream
+		msg.Cursor, _ = log.wait()
+	}
+	for {
+		_, wake := log.wait()
+		evs, ok := log.since(msg.Cursor)
+		if !ok {
+			msg.Resync = true
+			msg.Cursor, _ = log.wait()
+		}
+		if len(evs) > 0 || !ok {
+			for _, ev := range evs {
+				msg.Messages = append(msg.Messages, ev.Msg)
+				msg.Cursor = ev.Seq
+			}
+			return msg, nil
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return msg, nil
+		case <-ctx.Done():
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package bbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SchemaPath is where Serve publishes the protocol schema.
+const SchemaPath = "/.well-known/bbs-schema.json"
+
+// every message in the protocol, for the schema
+var protocol = []struct {
+	Cmd    string
+	Client bool // client -> server, otherwise server -> client
+	Type   interface{}
+}{
+	{"hello", true, HelloCommand{}},
+	{"login", true, LoginCommand{}},
+	{"logout", true, LogoutCommand{}},
+	{"register", true, RegisterCommand{}},
+	{"get", true, GetCommand{}},
+	{"list", true, ListCommand{}},
+	{"reply", true, ReplyCommand{}},
+	{"post", true, PostCommand{}},
+	{"listen", true, ListenCommand{}},
+	{"part", true, ListenCommand{}},
+	{"poll", true, PollCommand{}},
+	{"resume", true, ResumeCommand{}},
+	{"batch", true, BatchCommand{}},
+	{"sessions", true, SessionsCommand{}},
+	{"revoke", true, RevokeCommand{}},
+
+	{"hello", false, HelloMessage{}},
+	{"welcome", false, WelcomeMessage{}},
+	{"error", false, ErrorMessage{}},
+	{"ok", false, OKMessage{}},
+	{"msg", false, ThreadMessage{}},
+	{"list", false, ListMessage{}},
+	{"list", false, BoardListMessage{}},
+	{"list", false, BookmarkListMessage{}},
+	{"list", false, TagListMessage{}},
+	{"poll", false, PollMessage{}},
+	{"resume", false, ResumeMessage{}},
+	{"resync", false, ResyncMessage},
+	{"batch", false, BatchMessage{}},
+	{"sessions", false, SessionsMessage{}},
+}
+
+var (
+	schemaOnce sync.Once
+	schemaJSON []byte
+)
+
+// Schema returns a JSON Schema describing every message in the protocol, generated from the structs in this package.
+// Fields that belong to an option (like "range" or "avatars") are marked with "x-option".
+func Schema() []byte {
+	schemaOnce.Do(func() {
+		schemaJSON, _ = json.MarshalIndent(buildSchema(), "", "\t")
+	})
+	return schemaJSON
+}
+
+// ServeSchema serves the protocol schema.
+func ServeSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(Schema())
+}
+
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+func buildSchema() map[string]interface{} {
+	b := schemaBuilder{defs: make(map[string]interface{})}
+	client := make(map[string][]interface{})
+	server := make(map[string][]interface{})
+	for _, p := range protocol {
+		t := reflect.TypeOf(p.Type)
+		ref := b.ref(t, p.Client)
+		props := b.defs[t.Name()].(map[string]interface{})["properties"].(map[string]interface{})
+		if prev, ok := props["cmd"].(map[string]interface{})["const"]; ok && prev != p.Cmd {
+			// same struct for several commands, like "listen" and "part"
+			props["cmd"] = map[string]interface{}{"enum": []interface{}{prev, p.Cmd}}
+		} else {
+			props["cmd"] = map[string]interface{}{"const": p.Cmd}
+		}
+		if p.Client {
+			client[p.Cmd] = append(client[p.Cmd], ref)
+		} else {
+			server[p.Cmd] = append(server[p.Cmd], ref)
+		}
+	}
+	return map[string]interface{}{
+		"$schema":            "https://json-schema.org/draft/2020-12/schema",
+		"title":              "BBS protocol",
+		"x-protocol-version": version,
+		"$defs":              b.defs,
+		"x-client-commands":  oneOf(client),
+		"x-server-commands":  oneOf(server),
+	}
+}
+
+func oneOf(cmds map[string][]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(cmds))
+	for cmd, refs := range cmds {
+		if len(refs) == 1 {
+			out[cmd] = refs[0]
+		} else {
+			out[cmd] = map[string]interface{}{"oneOf": refs}
+		}
+	}
+	return out
+}
+
+// ref adds the struct type t to the definitions and returns a reference to it.
+// Fields of client commands other than "cmd" are never required; the server fills in defaults.
+// Fields of server messages, and of structs inside any message (like Range), are required unless they're omitempty.
+func (b *schemaBuilder) ref(t reflect.Type, client bool) map[string]interface{} {
+	ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	if _, done := b.defs[t.Name()]; done {
+		return ref
+	}
+	props := make(map[string]interface{})
+	def := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	b.defs[t.Name()] = def
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		prop := b.schemaFor(f.Type, client)
+		if opt := f.Tag.Get("option"); opt != "" {
+			prop["x-option"] = opt
+		}
+		props[name] = prop
+		if (!client && !contains(parts[1:], "omitempty")) || name == "cmd" {
+			required = append(required, name)
+		}
+	}
+	if len(required) > 0 {
+		def["required"] = required
+	}
+	return ref
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type, client bool) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem(), client)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem(), client)}
+	case reflect.Ptr:
+		return b.schemaFor(t.Elem(), client)
+	case reflect.Struct:
+		// shared by both directions, so the same rules everywhere
+		return b.ref(t, false)
+	}
+	// interface{}: anything goes
+	return map[string]interface{}{}
+}
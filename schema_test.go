@@ -0,0 +1,104 @@
+package bbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/bbs-schema.json")
+
+const schemaFile = "testdata/bbs-schema.json"
+
+// TestSchemaFile fails when the protocol structs change without updating the published schema.
+// Run "go test -run TestSchemaFile -update" after changing them on purpose.
+func TestSchemaFile(t *testing.T) {
+	got, err := json.MarshalIndent(buildSchema(), "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.WriteFile(schemaFile, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date with the protocol structs; run go test -run TestSchemaFile -update", schemaFile)
+	}
+}
+
+func TestSchemaCoversProtocol(t *testing.T) {
+	var schema struct {
+		Defs   map[string]schemaDef       `json:"$defs"`
+		Client map[string]json.RawMessage `json:"x-client-commands"`
+		Server map[string]json.RawMessage `json:"x-server-commands"`
+	}
+	if err := json.Unmarshal(Schema(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range protocol {
+		typ := reflect.TypeOf(p.Type)
+		cmds := schema.Server
+		if p.Client {
+			cmds = schema.Client
+		}
+		if !strings.Contains(string(cmds[p.Cmd]), `"#/$defs/`+typ.Name()+`"`) {
+			t.Errorf("%s: command %q doesn't refer to it", typ.Name(), p.Cmd)
+		}
+		checkDef(t, schema.Defs, typ, p.Client)
+	}
+}
+
+type schemaDef struct {
+	Properties map[string]map[string]interface{} `json:"properties"`
+	Required   []string                          `json:"required"`
+}
+
+// checkDef compares the definition of t, and the structs in it, with t's fields
+func checkDef(t *testing.T, defs map[string]schemaDef, typ reflect.Type, client bool) {
+	def, ok := defs[typ.Name()]
+	if !ok {
+		t.Errorf("%s: missing from $defs", typ.Name())
+		return
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		prop, ok := def.Properties[name]
+		if !ok {
+			t.Errorf("%s: field %q missing", typ.Name(), name)
+			continue
+		}
+		if opt := f.Tag.Get("option"); prop["x-option"] != nil != (opt != "") || (opt != "" && prop["x-option"] != opt) {
+			t.Errorf("%s.%s: x-option is %v, want %q", typ.Name(), name, prop["x-option"], opt)
+		}
+		required := name == "cmd" || (!client && !contains(parts[1:], "omitempty"))
+		if contains(def.Required, name) != required {
+			t.Errorf("%s.%s: required should be %v", typ.Name(), name, required)
+		}
+		elem := f.Type
+		for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Struct && elem != reflect.TypeOf(json.RawMessage{}) {
+			checkDef(t, defs, elem, false)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package bbs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// secure reports whether r came over TLS, either directly or through a trusted proxy
+func (srv *Server) secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	protos := r.Header["X-Forwarded-Proto"]
+	if len(protos) == 0 || !srv.trusted(r.RemoteAddr) {
+		return false
+	}
+	// the client can send its own; only the last one, added by our proxy, counts
+	list := strings.Split(protos[len(protos)-1], ",")
+	proto := strings.TrimSpace(list[len(list)-1])
+	return strings.EqualFold(proto, "https") || strings.EqualFold(proto, "wss")
+}
+
+// clientAddr returns the address of the client that sent r.
+// Behind trusted proxies, that's the rightmost X-Forwarded-For entry that isn't one of them;
+// anything to the left of it came from the client and could be made up.
+func (srv *Server) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if !srv.trusted(addr) {
+		return addr
+	}
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !srv.trusted(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// trusted reports whether addr is one of the TrustedProxies
+func (srv *Server) trusted(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, p := range srv.TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecure returns an error if credentials shouldn't be sent over this connection
+func (srv *Server) checkSecure(ctx context.Context) error {
+	if !srv.RequireSecure || Secure(ctx) {
+		return nil
+	}
+	if srv.secureURL == "" {
+		return NewError(CodeInsecure, "This server requires a secure connection")
+	}
+	return &CodeError{
+		Code:    CodeInsecure,
+		Message: "This server requires a secure connection: " + srv.secureURL,
+		Details: map[string]string{"secure": srv.secureURL},
+	}
+}
+
+// ServeTLS is like Serve, over HTTPS.
+// If certFile and keyFile are empty, it makes a self-signed certificate, which is only good for development.
+func ServeTLS(address, path, certFile, keyFile string, fact func() BBS) {
+	srv := mount(path, fact)
+	server := &http.Server{Addr: address}
+	if certFile == "" && keyFile == "" {
+		cert, err := selfSignedCert(address)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Warning: using a self-signed certificate, don't do this in production")
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	log.Printf("Starting BBS %s at https://%s%s\n", srv.Name, address, path)
+	err := server.ListenAndServeTLS(certFile, keyFile)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// selfSignedCert makes a certificate for localhost and the host in address
+func selfSignedCert(address string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"BBS development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,92 @@
+package bbs
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+var testProxies = []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+
+func TestSecure(t *testing.T) {
+	srv := &Server{TrustedProxies: testProxies}
+	tests := []struct {
+		remote string
+		protos []string // X-Forwarded-Proto header lines
+		tls    bool
+		want   bool
+	}{
+		{"1.2.3.4:5", nil, false, false},
+		{"1.2.3.4:5", nil, true, true},
+		// untrusted peers can't claim anything
+		{"1.2.3.4:5", []string{"https"}, false, false},
+		{"192.168.1.2:5", []string{"https"}, false, false},
+		// trusted proxies, by IP and CIDR
+		{"192.168.1.1:5", []string{"https"}, false, true},
+		{"10.1.2.3:5", []string{"https"}, false, true},
+		{"10.1.2.3:5", []string{"HTTPS"}, false, true},
+		{"10.1.2.3:5", []string{"wss"}, false, true},
+		{"10.1.2.3:5", []string{"http"}, false, false},
+		{"[fd00::1]:5", []string{"https"}, false, true},
+		// the client's own values come first; only the proxy's last one counts
+		{"10.1.2.3:5", []string{"https, http"}, false, false},
+		{"10.1.2.3:5", []string{"http, https"}, false, true},
+		{"10.1.2.3:5", []string{"https", "http"}, false, false},
+		{"10.1.2.3:5", []string{"http", "https"}, false, true},
+		{"10.1.2.3:5", []string{"http", " https "}, false, true},
+		{"10.1.2.3:5", nil, false, false},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		for _, p := range test.protos {
+			r.Header.Add("X-Forwarded-Proto", p)
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if got := srv.secure(r); got != test.want {
+			t.Errorf("secure(%s, %q, tls=%v) = %v, want %v", test.remote, test.protos, test.tls, got, test.want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	srv := &Server{TrustedProxies: testProxies}
+	tests := []struct {
+		remote string
+		xff    []string // X-Forwarded-For header lines
+		want   string
+	}{
+		{"1.2.3.4:5", nil, "1.2.3.4"},
+		// untrusted peers can't claim to be someone else
+		{"1.2.3.4:5", []string{"6.6.6.6"}, "1.2.3.4"},
+		{"192.168.1.2:5", []string{"6.6.6.6"}, "192.168.1.2"},
+		// a trusted proxy without a header is the client
+		{"10.0.0.1:5", nil, "10.0.0.1"},
+		{"10.0.0.1:5", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"192.168.1.1:5", []string{"1.2.3.4"}, "1.2.3.4"},
+		// spoofed hops to the left of the real client are ignored
+		{"10.0.0.1:5", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:5", []string{"6.6.6.6,1.2.3.4"}, "1.2.3.4"},
+		// chains of trusted proxies are skipped
+		{"10.0.0.1:5", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2, 192.168.1.1"}, "1.2.3.4"},
+		{"[fd00::1]:5", []string{"6.6.6.6, 2001:db8::1, fd00::2"}, "2001:db8::1"},
+		// several header lines count as one list
+		{"10.0.0.1:5", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:5", []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, "1.2.3.4"},
+		// garbage stops the walk at the last good hop
+		{"10.0.0.1:5", []string{"6.6.6.6, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:5", []string{"garbage"}, "10.0.0.1"},
+		// everything trusted: the leftmost proxy is as far as we can tell
+		{"10.0.0.1:5", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		for _, h := range test.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := RemoteAddr(srv.withRequest(r.Context(), r)); got != test.want {
+			t.Errorf("client address for %s, %q = %q, want %q", test.remote, test.xff, got, test.want)
+		}
+	}
+}
@@ -1,24 +1,105 @@
 package bbs
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Session is a logged-in user, or a guest websocket connection.
+// A logged-in session can be used by several connections at once (HTTP, websockets, SSE).
+// They share the session's BBS, and the server sends it one command at a time.
+// The exported fields don't change once the session is logged in.
 type Session struct {
-	SessionID  string
-	UserID     string
-	BBS        BBS
-	LastAction time.Time
+	lastAction int64 // unix nanoseconds, atomic; first for alignment on 32-bit
+
+	SessionID string
+	UserID    string
+	BBS       BBS
+	Created   time.Time
+	UserAgent string
+	Addr      string // IP address the session logged in from
+
+	mu      sync.Mutex
+	events  *eventLog // what BBS sends realtime messages to; each connection follows it separately
+	version int       // negotiated protocol version
+	conns   int       // attached websocket and SSE connections
+
+	backend sync.Mutex // held while running a command against BBS
+}
+
+// ProtocolVersion returns the protocol version negotiated with the client.
+func (s *Session) ProtocolVersion() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// LastActive returns when the session was last used.
+func (s *Session) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastAction))
+}
+
+// touch marks the session as used now
+func (s *Session) touch() {
+	now := time.Now().UnixNano()
+	// skip the write if it's recent enough, so busy sessions don't fight over the cache line
+	if now-atomic.LoadInt64(&s.lastAction) > int64(touchResolution) {
+		atomic.StoreInt64(&s.lastAction, now)
+	}
+}
+
+// Connections returns how many websocket and SSE connections are using the session.
+func (s *Session) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *Session) attach() {
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+}
+
+func (s *Session) detach() {
+	s.mu.Lock()
+	s.conns--
+	s.mu.Unlock()
+}
+
+// PublicID returns an ID for the session that's safe to show to others,
+// unlike SessionID which logs you in.
+func (s *Session) PublicID() string {
+	sum := sha256.Sum256([]byte(s.SessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Session) setVersion(v int) {
+	s.mu.Lock()
+	s.version = v
+	s.mu.Unlock()
 }
 
 type SessionHandler struct {
 	Server *Server
+	Guard  *LoginGuard // protects against password guessing, off unless set (e.g. to NewLoginGuard())
+	// Tokens, if set, makes session IDs signed tokens that any server with the same keys accepts.
+	// Backends must implement Restorer. Logging out only forgets the session on this server;
+	// the token works elsewhere until it expires.
+	Tokens *TokenSigner
 
 	sessions     map[string]*Session
+	byUser       map[string]map[string]*Session // user ID -> session ID -> session
+	revoked      map[string]int64               // signed tokens logged out before they expire -> expiry
 	sessionMutex sync.RWMutex
 }
 
@@ -26,29 +107,79 @@ func NewSessionHandler(srv *Server) *SessionHandler {
 	return &SessionHandler{
 		Server:       srv,
 		sessions:     make(map[string]*Session),
+		byUser:       make(map[string]map[string]*Session),
+		revoked:      make(map[string]int64),
 		sessionMutex: sync.RWMutex{},
 	}
 }
 
 func (sh *SessionHandler) Get(sesh string) *Session {
+	if sh.Tokens != nil && strings.HasPrefix(sesh, tokenPrefix) {
+		return sh.restore(sesh)
+	}
 	sh.sessionMutex.RLock()
 	defer sh.sessionMutex.RUnlock()
 	s, ok := sh.sessions[sesh]
 	if !ok {
 		return nil
 	}
-	// update last active time in a diff thread
-	go sh.Touch(sesh)
+	s.touch()
 	return s
 }
 
-func (sh *SessionHandler) Touch(sesh string) {
+// restore returns the session for a signed token, making a new one if it came from another server
+func (sh *SessionHandler) restore(token string) *Session {
+	c, err := sh.Tokens.verify(token)
+	if err != nil {
+		sh.expire(token)
+		return nil
+	}
+	sh.sessionMutex.RLock()
+	s := sh.sessions[token]
+	_, revoked := sh.revoked[token]
+	sh.sessionMutex.RUnlock()
+	if revoked {
+		return nil
+	}
+	if s != nil {
+		s.touch()
+		return s
+	}
+
+	board := sh.Server.NewBBS()
+	r, ok := board.(Restorer)
+	if !ok || !r.Restore(c.UserID) {
+		return nil
+	}
+	s = &Session{
+		SessionID: token,
+		UserID:    c.UserID,
+		BBS:       board,
+		Created:   time.Unix(c.IssuedAt, 0),
+		version:   c.Version,
+	}
+	s.touch()
 	sh.sessionMutex.Lock()
+	defer sh.sessionMutex.Unlock()
+	if existing := sh.sessions[token]; existing != nil {
+		// someone else restored it first
+		return existing
+	}
+	if _, revoked := sh.revoked[token]; revoked {
+		return nil
+	}
+	sh.add(s)
+	return s
+}
+
+// Touch marks a session as used now. Get does this already.
+func (sh *SessionHandler) Touch(sesh string) {
+	sh.sessionMutex.RLock()
 	s := sh.sessions[sesh]
+	sh.sessionMutex.RUnlock()
 	if s != nil {
-		s.LastAction = time.Now()
+		s.touch()
 	}
-	sh.sessionMutex.Unlock()
 }
 
 func (sh *SessionHandler) Add(sesh *Session) {
@@ -58,32 +189,99 @@ func (sh *SessionHandler) Add(sesh *Session) {
 	if _, exists := sh.sessions[sesh.SessionID]; exists {
 		log.Printf("Warning: replaced already-existing session %s", sesh.SessionID)
 	}
+	sh.add(sesh)
+}
 
+func (sh *SessionHandler) add(sesh *Session) {
 	sh.sessions[sesh.SessionID] = sesh
+	if sesh.UserID == "" {
+		return
+	}
+	if sh.byUser[sesh.UserID] == nil {
+		sh.byUser[sesh.UserID] = make(map[string]*Session)
+	}
+	sh.byUser[sesh.UserID][sesh.SessionID] = sesh
+}
+
+// UserSessions returns the sessions userID is logged in with on this server.
+func (sh *SessionHandler) UserSessions(userID string) []*Session {
+	sh.sessionMutex.RLock()
+	defer sh.sessionMutex.RUnlock()
+	var list []*Session
+	for _, s := range sh.byUser[userID] {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
 }
 
+// LogoutUser logs out all of userID's sessions, for example after a password change.
+// It returns how many sessions were logged out.
+// Like Logout, it waits for commands running on them, so don't call it from a BBS method.
+func (sh *SessionHandler) LogoutUser(userID string) int {
+	sessions := sh.UserSessions(userID)
+	for _, s := range sessions {
+		sh.Logout(s.SessionID)
+	}
+	return len(sessions)
+}
+
+// TryLogin logs in to a new backend and returns the new session, or nil if it failed.
 func (sh *SessionHandler) TryLogin(m LoginCommand) *Session {
+	return sh.TryLoginContext(context.Background(), m)
+}
+
+// TryLoginContext is like TryLogin, passing ctx on to backends that implement ContextBBS.
+func (sh *SessionHandler) TryLoginContext(ctx context.Context, m LoginCommand) *Session {
 	//try to log in
 	var board BBS
 	board = sh.Server.NewBBS()
-	if board.LogIn(m) {
+	if userID, ok := sh.guardedLogIn(ctx, board, m); ok {
+		id, err := sh.newSessionID(userID, m)
+		if err != nil {
+			log.Println("login:", err)
+			return nil
+		}
 		sesh := &Session{
-			SessionID:  sessionKey(),
-			UserID:     m.Username,
-			BBS:        board,
-			LastAction: time.Now(),
+			SessionID: id,
+			UserID:    userID,
+			BBS:       board,
+			Created:   time.Now(),
+			UserAgent: UserAgent(ctx),
+			Addr:      RemoteAddr(ctx),
 		}
+		sesh.touch()
 		sh.Add(sesh)
 		return sesh
 	}
 	return nil
 }
 
+// Upgrade logs in a guest session that isn't shared yet, like a new websocket connection's.
+// Logged-in sessions can't be upgraded; use TryLogin to get a new one.
 func (sh *SessionHandler) Upgrade(sesh *Session, m LoginCommand) bool {
-	if sesh.BBS.LogIn(m) {
-		sesh.SessionID = sessionKey()
-		sesh.UserID = m.Username
-		sesh.LastAction = time.Now()
+	return sh.UpgradeContext(context.Background(), sesh, m)
+}
+
+// UpgradeContext is like Upgrade, passing ctx on to backends that implement ContextBBS.
+func (sh *SessionHandler) UpgradeContext(ctx context.Context, sesh *Session, m LoginCommand) bool {
+	if sesh.SessionID != "" {
+		return false
+	}
+	if userID, ok := sh.guardedLogIn(ctx, sesh.BBS, m); ok {
+		id, err := sh.newSessionID(userID, m)
+		if err != nil {
+			log.Println("login:", err)
+			return false
+		}
+		sesh.SessionID = id
+		sesh.UserID = userID
+		sesh.Created = time.Now()
+		sesh.UserAgent = UserAgent(ctx)
+		sesh.Addr = RemoteAddr(ctx)
+		sesh.touch()
 
 		sh.Add(sesh)
 		return true
@@ -91,19 +289,162 @@ func (sh *SessionHandler) Upgrade(sesh *Session, m LoginCommand) bool {
 	return false
 }
 
-func (sh *SessionHandler) Copy(from *Session, to *Session) {
-	to.SessionID = from.SessionID
-	to.UserID = from.UserID
-	to.BBS = from.BBS
-	to.LastAction = from.LastAction
+// Logout forgets a session, waiting for any command running on it to finish.
+func (sh *SessionHandler) Logout(sesh string) {
+	sh.logout(sesh, nil)
 }
 
-func (sh *SessionHandler) Logout(sesh string) {
+// logout forgets a session and disconnects its backend from realtime events.
+// held is the session whose backend the caller is running a command on, if any.
+func (sh *SessionHandler) logout(sesh string, held *Session) {
+	sh.sessionMutex.Lock()
+	s := sh.remove(sesh)
+	if sh.Tokens != nil && strings.HasPrefix(sesh, tokenPrefix) {
+		sh.revoke(sesh)
+	}
+	sh.sessionMutex.Unlock()
+
+	switch {
+	case s == nil:
+	case s == held:
+		s.bye()
+	case held == nil:
+		s.backend.Lock()
+		s.bye()
+		s.backend.Unlock()
+	default:
+		// waiting for another session's backend while holding ours
+		// could deadlock if it's logging us out at the same time
+		go s.byeLater()
+	}
+}
+
+// expire forgets a session whose token doesn't verify anymore.
+// The caller may be running a command on it, so it doesn't wait for the backend.
+func (sh *SessionHandler) expire(token string) {
+	sh.sessionMutex.RLock()
+	_, ok := sh.sessions[token]
+	sh.sessionMutex.RUnlock()
+	if !ok {
+		return
+	}
 	sh.sessionMutex.Lock()
-	delete(sh.sessions, sesh)
+	s := sh.remove(token)
 	sh.sessionMutex.Unlock()
+	if s != nil {
+		go s.byeLater()
+	}
+}
+
+// remove deletes a session from the maps and returns it; the caller holds sessionMutex
+func (sh *SessionHandler) remove(id string) *Session {
+	s := sh.sessions[id]
+	if s == nil {
+		return nil
+	}
+	delete(sh.sessions, id)
+	delete(sh.byUser[s.UserID], id)
+	if len(sh.byUser[s.UserID]) == 0 {
+		delete(sh.byUser, s.UserID)
+	}
+	return s
+}
+
+// byeLater waits for the backend to be free, then disconnects it from realtime events
+func (s *Session) byeLater() {
+	s.backend.Lock()
+	s.bye()
+	s.backend.Unlock()
+}
+
+// bye disconnects the backend from realtime events; the caller holds s.backend
+func (s *Session) bye() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.BBS.(Realtime); ok && s.events != nil {
+		r.Bye()
+	}
+}
+
+// list answers a "sessions" command
+func (sh *SessionHandler) list(current *Session) SessionsMessage {
+	msg := SessionsMessage{Command: "sessions", Sessions: []SessionListing{}}
+	sh.sessionMutex.RLock()
+	defer sh.sessionMutex.RUnlock()
+	for _, s := range sh.byUser[current.UserID] {
+		msg.Sessions = append(msg.Sessions, SessionListing{
+			ID:          s.PublicID(),
+			Created:     s.Created.Format(time.RFC3339),
+			LastActive:  s.LastActive().Format(time.RFC3339),
+			UserAgent:   s.UserAgent,
+			IP:          s.Addr,
+			Connections: s.Connections(),
+			Current:     s.SessionID == current.SessionID,
+		})
+	}
+	sort.Slice(msg.Sessions, func(i, j int) bool {
+		return msg.Sessions[i].Created < msg.Sessions[j].Created
+	})
+	return msg
+}
+
+// revokeFor answers a "revoke" command
+func (sh *SessionHandler) revokeFor(current *Session, m RevokeCommand) error {
+	if m.ID == "" && !m.Others {
+		return NewError(CodeValidation, "id or others is required")
+	}
+	found := false
+	for _, s := range sh.UserSessions(current.UserID) {
+		switch {
+		case m.Others && s.SessionID != current.SessionID,
+			m.ID != "" && s.PublicID() == m.ID:
+			sh.logout(s.SessionID, current)
+			found = true
+		}
+	}
+	if m.ID != "" && !found {
+		return ErrNotFound
+	}
+	return nil
 }
 
+// revoke keeps a signed token from being restored until it expires
+func (sh *SessionHandler) revoke(token string) {
+	c, err := sh.Tokens.verify(token)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for t, exp := range sh.revoked {
+		if exp <= now {
+			delete(sh.revoked, t)
+		}
+	}
+	sh.revoked[token] = c.Expires
+}
+
+// authenticate logs in to b with the login method in m, returning the user ID
+func authenticate(ctx context.Context, b BBS, m LoginCommand) (userID string, ok bool) {
+	if m.Method == "" || m.Method == LoginPassword {
+		return m.Username, logIn(ctx, b, m)
+	}
+	if a, ok := b.(Authenticator); ok && contains(a.LoginMethods(), m.Method) {
+		return a.Authenticate(m)
+	}
+	return "", false
+}
+
+func (sh *SessionHandler) newSessionID(userID string, m LoginCommand) (string, error) {
+	if sh.Tokens == nil {
+		return sessionKey(), nil
+	}
+	v, _ := negotiate(m.MinVersion, m.ProtocolVersion)
+	return sh.Tokens.issue(userID, v)
+}
+
+// how precisely LastActive is kept
+const touchResolution = time.Second
+
 func sessionKey() string {
 	//TODO: make this better
 	b := make([]byte, 16)
@@ -0,0 +1,227 @@
+package bbs
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBBS is a realtime backend with no locking of its own,
+// so the race detector catches the server calling it from two goroutines at once.
+type testBBS struct {
+	user     string
+	listener Listener
+}
+
+func (b *testBBS) Hello() HelloMessage {
+	return HelloMessage{Command: "hello", Name: "test", Access: AccessInfo{UserCommands: []string{"post", "reply"}}}
+}
+func (b *testBBS) Register(m RegisterCommand) (OKMessage, error) { return OK("register"), nil }
+func (b *testBBS) LogIn(m LoginCommand) bool {
+	if m.Password != "pw" {
+		return false
+	}
+	b.user = m.Username
+	return true
+}
+func (b *testBBS) LogOut(m LogoutCommand) OKMessage { b.user = ""; return OK("logout") }
+func (b *testBBS) IsLoggedIn() bool                 { return b.user != "" }
+func (b *testBBS) Get(m GetCommand) (ThreadMessage, error) {
+	if b.listener != nil {
+		b.listener.Send(OKMessage{Command: "ok", ReplyTo: "get"})
+	}
+	return ThreadMessage{Command: "msg", ID: m.ThreadID}, nil
+}
+func (b *testBBS) List(m ListCommand) (ListMessage, error)   { return ListMessage{Command: "list"}, nil }
+func (b *testBBS) Reply(m ReplyCommand) (OKMessage, error)   { return OK("reply"), nil }
+func (b *testBBS) Post(m PostCommand) (OKMessage, error)     { return OK("post"), nil }
+func (b *testBBS) Listen(m ListenCommand) (OKMessage, error) { return OK("listen"), nil }
+func (b *testBBS) Part(m ListenCommand) (OKMessage, error)   { return OK("part"), nil }
+func (b *testBBS) Connect(l Listener)                        { b.listener = l }
+func (b *testBBS) Bye()                                      { b.listener = nil }
+
+func newTestServer() *Server {
+	return NewServer(func() BBS { return &testBBS{} })
+}
+
+func login(t *testing.T, sh *SessionHandler, username string) *Session {
+	sesh := sh.TryLogin(LoginCommand{Command: "login", Username: username, Password: "pw"})
+	if sesh == nil {
+		t.Fatal("couldn't log in as", username)
+	}
+	return sesh
+}
+
+// run sends a command for sesh through the server
+func run(srv *Server, sesh *Session, cmd, data string) interface{} {
+	return srv.Handle(context.Background(), BBSCommand{Command: cmd}, []byte(data), sesh)
+}
+
+func TestSessionsConcurrent(t *testing.T) {
+	srv := newTestServer()
+	sh := srv.Sessions
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, login(t, sh, "user"+strconv.Itoa(i%5)).SessionID)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			guestName := "guest" + strconv.Itoa(g)
+			for i := 0; i < 200; i++ {
+				id := ids[(g+i)%len(ids)]
+				if sesh := sh.Get(id); sesh != nil {
+					sesh.LastActive()
+					sesh.Connections()
+					sh.list(sesh)
+				}
+				sh.Touch(id)
+				guest := &Session{BBS: srv.NewBBS()}
+				if !sh.UpgradeContext(ctx, guest, LoginCommand{Command: "login", Username: guestName, Password: "pw"}) {
+					t.Error("couldn't upgrade", guestName)
+					return
+				}
+				if i%20 == 0 {
+					sh.Logout(id)
+					sh.LogoutUser("guest" + strconv.Itoa((g+1)%8))
+				}
+				sh.UserSessions("user1")
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		sh.Logout(id)
+		if sh.Get(id) != nil {
+			t.Error("session still there after logout:", id)
+		}
+	}
+	for g := 0; g < 8; g++ {
+		sh.LogoutUser("guest" + strconv.Itoa(g))
+	}
+	if n := len(sh.sessions); n != 0 {
+		t.Error("leftover sessions:", n)
+	}
+	if n := len(sh.byUser); n != 0 {
+		t.Error("leftover users:", n)
+	}
+}
+
+func TestLogoutWhileBusy(t *testing.T) {
+	srv := newTestServer()
+	sh := srv.Sessions
+	for i := 0; i < 20; i++ {
+		sesh := login(t, sh, "user")
+		srv.events(sesh)
+
+		var wg sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					run(srv, sesh, "get", `{"cmd":"get","id":"1"}`)
+				}
+			}()
+		}
+		switch i % 3 {
+		case 0:
+			sh.Logout(sesh.SessionID)
+		case 1:
+			sh.LogoutUser("user")
+		case 2:
+			run(srv, sesh, "logout", `{"cmd":"logout","session":"`+sesh.SessionID+`"}`)
+		}
+		wg.Wait()
+		if sh.Get(sesh.SessionID) != nil {
+			t.Fatal("session still there after logout")
+		}
+	}
+}
+
+func TestRevokeEachOther(t *testing.T) {
+	srv := newTestServer()
+	sh := srv.Sessions
+	for i := 0; i < 20; i++ {
+		a, b := login(t, sh, "user"), login(t, sh, "user")
+		srv.events(a)
+		srv.events(b)
+
+		done := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			for _, sesh := range []*Session{a, b} {
+				wg.Add(1)
+				go func(sesh *Session) {
+					defer wg.Done()
+					run(srv, sesh, "revoke", `{"cmd":"revoke","session":"`+sesh.SessionID+`","others":true}`)
+				}(sesh)
+			}
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlocked revoking each other")
+		}
+		if len(sh.UserSessions("user")) > 1 {
+			t.Fatal("both sessions survived")
+		}
+		sh.LogoutUser("user")
+	}
+}
+
+func TestReloginExpiredToken(t *testing.T) {
+	srv := newTestServer()
+	sh := srv.Sessions
+	sh.Tokens = NewTokenSigner(-time.Second, SigningKey{ID: "k", Secret: []byte("secret")})
+	sesh := login(t, sh, "user")
+	srv.events(sesh)
+
+	done := make(chan interface{})
+	go func() {
+		done <- run(srv, sesh, "login", `{"cmd":"login","session":"`+sesh.SessionID+`"}`)
+	}()
+	select {
+	case res := <-done:
+		if msg, ok := res.(ErrorMessage); !ok || msg.Code != CodeSessionExpired {
+			t.Errorf("re-login with an expired token: %#v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked re-logging in with an expired token")
+	}
+	if n := len(sh.UserSessions("user")); n != 0 {
+		t.Error("expired session still there:", n)
+	}
+}
+
+func TestFirstPollWhileBusy(t *testing.T) {
+	srv := newTestServer()
+	sh := srv.Sessions
+	for i := 0; i < 20; i++ {
+		sesh := login(t, sh, "user")
+
+		var wg sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					run(srv, sesh, "get", `{"cmd":"get","id":"1"}`)
+				}
+			}()
+		}
+		// the first poll connects the backend while the gets are using it
+		run(srv, sesh, "poll", `{"cmd":"poll","session":"`+sesh.SessionID+`","timeout":1}`)
+		wg.Wait()
+		sh.Logout(sesh.SessionID)
+	}
+}
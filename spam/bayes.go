@@ -0,0 +1,74 @@
+package spam
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/guregu/bbs"
+)
+
+// Bayes is a naive Bayes classifier that learns what spam looks like from posts you Train it with.
+// It does nothing until it has seen both spam and non-spam.
+type Bayes struct {
+	Threshold float64 // probability of spam at which to reject, 0.9 if zero
+	Hold      bool
+
+	mu     sync.RWMutex
+	counts [2]map[string]int // [ham, spam] word -> count
+	words  [2]int            // total words seen in each class
+	docs   [2]int            // posts seen in each class
+}
+
+// Train teaches the classifier that text is (or isn't) spam.
+func (f *Bayes) Train(text string, spam bool) {
+	class := 0
+	if spam {
+		class = 1
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts[class] == nil {
+		f.counts[class] = make(map[string]int)
+	}
+	for _, w := range words(text) {
+		f.counts[class][w]++
+		f.words[class]++
+	}
+	f.docs[class]++
+}
+
+// Score returns the probability that text is spam, from 0 to 1.
+func (f *Bayes) Score(text string) float64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.docs[0] == 0 || f.docs[1] == 0 {
+		return 0
+	}
+	vocab := len(f.counts[0]) + len(f.counts[1])
+	var logp [2]float64
+	for class := range logp {
+		logp[class] = math.Log(float64(f.docs[class]) / float64(f.docs[0]+f.docs[1]))
+		for _, w := range words(text) {
+			// add-one smoothing so unseen words don't zero everything out
+			p := float64(f.counts[class][w]+1) / float64(f.words[class]+vocab)
+			logp[class] += math.Log(p)
+		}
+	}
+	// P(spam) = 1 / (1 + e^(log P(ham) - log P(spam)))
+	return 1 / (1 + math.Exp(logp[0]-logp[1]))
+}
+
+func (f *Bayes) Check(ctx context.Context, c *bbs.Content) error {
+	if c.Command == "register" {
+		return nil
+	}
+	threshold := f.Threshold
+	if threshold == 0 {
+		threshold = 0.9
+	}
+	if f.Score(c.Title+" "+c.Text) >= threshold {
+		return reject(f.Hold, "bayes", "Your message looks like spam")
+	}
+	return nil
+}
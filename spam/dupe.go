@@ -0,0 +1,109 @@
+package spam
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+// Duplicates rejects posts and replies whose text was already posted recently,
+// by the same user (or address, for guests), or by anyone more than Max times.
+// Whitespace and case don't count.
+// Only posts that made it to the backend count; the server reports them through Accepted.
+type Duplicates struct {
+	Window    time.Duration // how long to remember posts
+	Max       int           // how many times anyone may post the same text in Window, 0 for no limit
+	MinLength int           // shorter texts (like "lol") are never duplicates
+	Hold      bool
+
+	mu      sync.Mutex
+	seen    map[[sha256.Size]byte][]sighting
+	cleaned time.Time
+}
+
+type sighting struct {
+	who  string
+	when time.Time
+}
+
+func (f *Duplicates) Check(ctx context.Context, c *bbs.Content) error {
+	sum, who, ok := f.key(c)
+	if !ok {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	recent := f.recent(sum, now)
+	for _, s := range recent {
+		if s.who == who {
+			return reject(f.Hold, "duplicate", "You already posted that")
+		}
+	}
+	if f.Max > 0 && len(recent) >= f.Max {
+		return reject(f.Hold, "duplicate", "That was already posted too many times")
+	}
+	return nil
+}
+
+// Accepted remembers c once it's been posted, so rejected or held content doesn't count.
+func (f *Duplicates) Accepted(ctx context.Context, c *bbs.Content) {
+	sum, who, ok := f.key(c)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.seen[sum] = append(f.recent(sum, now), sighting{who, now})
+}
+
+// key returns what c's text is remembered by and who sent it, or false if it can't be a duplicate
+func (f *Duplicates) key(c *bbs.Content) (sum [sha256.Size]byte, who string, ok bool) {
+	if c.Command == "register" {
+		return sum, "", false
+	}
+	text := strings.Join(words(c.Text), " ")
+	if len(text) < f.MinLength || text == "" {
+		return sum, "", false
+	}
+	who = c.UserID
+	if who == "" {
+		who = "@" + c.Addr
+	}
+	return sha256.Sum256([]byte(text)), who, true
+}
+
+// recent returns the sightings of sum within Window, forgetting older ones
+func (f *Duplicates) recent(sum [sha256.Size]byte, now time.Time) []sighting {
+	if f.seen == nil {
+		f.seen = make(map[[sha256.Size]byte][]sighting)
+	}
+	if now.Sub(f.cleaned) > f.Window {
+		f.clean(now)
+	}
+	var recent []sighting
+	for _, s := range f.seen[sum] {
+		if now.Sub(s.when) < f.Window {
+			recent = append(recent, s)
+		}
+	}
+	f.seen[sum] = recent
+	return recent
+}
+
+// clean forgets old posts
+func (f *Duplicates) clean(now time.Time) {
+	for sum, ss := range f.seen {
+		if len(ss) == 0 || now.Sub(ss[len(ss)-1].when) >= f.Window {
+			delete(f.seen, sum)
+		}
+	}
+	f.cleaned = now
+}
@@ -0,0 +1,74 @@
+package spam
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/guregu/bbs"
+)
+
+// ProofOfWork makes clients spend some CPU time on each post, reply and registration.
+// The "challenge" field must be a string such that the SHA-256 of
+//
+//	cmd + "\n" + subject + "\n" + challenge
+//
+// starts with Bits zero bits, where subject is the title and body for "post" (joined by "\n"),
+// the thread ID and body for "reply", and the username for "register".
+// The same answer works for the same content again, so use Duplicates too.
+type ProofOfWork struct {
+	Bits int
+}
+
+func (f *ProofOfWork) Challenge() bbs.ChallengeInfo {
+	return bbs.ChallengeInfo{Type: "pow", Bits: f.Bits}
+}
+
+func (f *ProofOfWork) Check(ctx context.Context, c *bbs.Content) error {
+	if zeroBits(powInput(c, c.Challenge)) >= f.Bits {
+		return nil
+	}
+	return &bbs.CodeError{
+		Code:    bbs.CodeChallenge,
+		Message: "Missing or wrong proof of work",
+		Details: map[string]string{"type": "pow", "bits": strconv.Itoa(f.Bits)},
+	}
+}
+
+// Solve finds a proof of work for c with the given difficulty, for clients written in Go.
+func Solve(c *bbs.Content, difficulty int) string {
+	for i := 0; ; i++ {
+		answer := strconv.Itoa(i)
+		if zeroBits(powInput(c, answer)) >= difficulty {
+			return answer
+		}
+	}
+}
+
+func powInput(c *bbs.Content, answer string) []byte {
+	var subject string
+	switch c.Command {
+	case "post":
+		subject = c.Title + "\n" + c.Text
+	case "reply":
+		subject = c.To + "\n" + c.Text
+	case "register":
+		subject = c.Username
+	}
+	return []byte(strings.Join([]string{c.Command, subject, answer}, "\n"))
+}
+
+// zeroBits counts the leading zero bits of data's hash
+func zeroBits(data []byte) int {
+	sum := sha256.Sum256(data)
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
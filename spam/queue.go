@@ -0,0 +1,61 @@
+package spam
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+// Queue is a moderation queue in memory.
+// Moderators look at Pending items, and Take the ones they've dealt with.
+// To publish an approved item, send its Content.Data to the backend as its user.
+// Registrations can't be replayed that way, since the password isn't kept.
+type Queue struct {
+	mu    sync.Mutex
+	items []Item
+	next  int
+}
+
+// Item is content held for moderation.
+type Item struct {
+	ID      string
+	Content bbs.Content
+	Reason  string
+	Held    time.Time
+}
+
+func (q *Queue) Hold(ctx context.Context, c bbs.Content, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	q.items = append(q.items, Item{
+		ID:      strconv.Itoa(q.next),
+		Content: c,
+		Reason:  reason,
+		Held:    time.Now(),
+	})
+	return nil
+}
+
+// Pending returns the items waiting for a moderator, oldest first.
+func (q *Queue) Pending() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Item(nil), q.items...)
+}
+
+// Take removes an item from the queue and returns it.
+func (q *Queue) Take(id string) (Item, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return item, true
+		}
+	}
+	return Item{}, false
+}
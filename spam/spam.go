@@ -0,0 +1,90 @@
+// Package spam has filters for the server's content filter pipeline (Server.Filters).
+//
+// Each filter either rejects content with a "spam" error, or, if its Hold field is set,
+// sends it to the server's moderation queue instead:
+//
+//	srv.Filters = []bbs.Filter{
+//		&spam.ProofOfWork{Bits: 16},
+//		&spam.WordFilter{Words: []string{"cheap pills"}},
+//		&spam.LinkLimit{Max: 0, NewFor: 24 * time.Hour, Joined: joined},
+//		&spam.Duplicates{Window: time.Hour},
+//		&spam.Bayes{Threshold: 0.95, Hold: true},
+//	}
+//	srv.Moderation = &spam.Queue{}
+package spam
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/guregu/bbs"
+)
+
+// reject makes the error for content a filter doesn't like
+func reject(hold bool, filter, msg string) error {
+	if hold {
+		return bbs.Held(filter + ": " + msg)
+	}
+	return &bbs.CodeError{
+		Code:    bbs.CodeSpam,
+		Message: msg,
+		Details: map[string]string{"filter": filter},
+	}
+}
+
+// words splits text into lowercase words
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// WordFilter rejects content containing any of Words, matched case-insensitively as whole words.
+// Entries can be phrases, like "cheap pills".
+type WordFilter struct {
+	Words []string
+	Hold  bool
+}
+
+func (f *WordFilter) Check(ctx context.Context, c *bbs.Content) error {
+	text := " " + strings.Join(words(c.Title+" "+c.Text+" "+c.Username), " ") + " "
+	for _, w := range f.Words {
+		if strings.Contains(text, " "+strings.Join(words(w), " ")+" ") {
+			return reject(f.Hold, "words", "Your message contains a forbidden word")
+		}
+	}
+	return nil
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+`)
+
+// LinkLimit limits how many links new users can post. Guests count as new.
+type LinkLimit struct {
+	Max    int           // most links allowed
+	NewFor time.Duration // how long users are new for
+	// Joined returns when a user signed up, and false if unknown (counted as new).
+	Joined func(userID string) (time.Time, bool)
+	Hold   bool
+}
+
+func (f *LinkLimit) Check(ctx context.Context, c *bbs.Content) error {
+	if c.Command == "register" {
+		return nil
+	}
+	if c.UserID != "" && f.Joined != nil {
+		if joined, ok := f.Joined(c.UserID); ok && time.Since(joined) >= f.NewFor {
+			return nil
+		}
+	}
+	if n := len(linkPattern.FindAllString(c.Title+" "+c.Text, -1)); n > f.Max {
+		if f.Max == 0 {
+			return reject(f.Hold, "links", "New users can't post links")
+		}
+		return reject(f.Hold, "links", "New users can only post "+strconv.Itoa(f.Max)+" links")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package bbs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how often to send a comment down idle event streams, so proxies don't hang up
+const sseHeartbeat = 30 * time.Second
+
+// ServeSSE streams a session's realtime messages as Server-Sent Events.
+// The session token goes in the "session" query parameter, since EventSource can't set headers.
+// Subscribe by POSTing "listen" and "part" commands with the same session.
+// Each event's ID is its sequence number, so browsers resume with Last-Event-ID after reconnecting.
+// If events were missed and can't be replayed, a "resync" event is sent first
+// and the client should re-"get" whatever it's showing.
+// The stream ends soon after the session is logged out.
+func (srv *Server) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if !srv.cors().apply(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == "OPTIONS" {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sesh := srv.Sessions.Get(r.FormValue("session"))
+	if sesh == nil {
+		http.Error(w, string(jsonify(SessionErrorMessage)), http.StatusUnauthorized)
+		return
+	}
+	log := srv.events(sesh)
+	sesh.attach()
+	defer sesh.detach()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	cursor, _ := log.wait()
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		if seq, err := strconv.ParseUint(last, 10, 64); err == nil {
+			cursor = seq
+		}
+	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		evs, ok := log.since(cursor)
+		if !ok {
+			fmt.Fprintf(w, "event: resync\ndata: {\"cmd\":\"resync\"}\n\n")
+		}
+		for _, ev := range evs {
+			data, err := json.Marshal(ev.Msg)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.Seq, data)
+			cursor = ev.Seq
+		}
+		if !ok && len(evs) == 0 {
+			cursor, _ = log.wait()
+		}
+		flusher.Flush()
+
+		latest, wake := log.wait()
+		if latest > cursor {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+		// logged out or expired
+		if srv.Sessions.Get(sesh.SessionID) == nil {
+			return
+		}
+	}
+}
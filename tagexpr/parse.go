@@ -0,0 +1,205 @@
+package tagexpr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/guregu/bbs"
+)
+
+// SyntaxError is returned for malformed tag expressions.
+type SyntaxError struct {
+	Expr string // the whole expression
+	Pos  int    // byte offset of the problem
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bad tag expression %q: %s at position %d", e.Expr, e.Msg, e.Pos+1)
+}
+
+// Unwrap lets the server report syntax errors with the "validation" error code.
+func (e *SyntaxError) Unwrap() error {
+	return bbs.ErrValidation
+}
+
+const operators = "|+&-()"
+
+// Parse parses a tag expression like "Dogs+Pizza-Anime".
+func Parse(s string) (Expr, error) {
+	p := &parser{src: s}
+	p.next()
+	if p.tok == tokEOF {
+		return And{}, nil
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != tokEOF {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return e, nil
+}
+
+type token int
+
+const (
+	tokEOF token = iota
+	tokTag
+	tokOr
+	tokAnd
+	tokNot
+	tokOpen
+	tokClose
+)
+
+type parser struct {
+	src string
+	off int // read offset
+
+	tok token
+	pos int    // offset of tok
+	lit string // tag name, for tokTag
+}
+
+// next reads the next token
+func (p *parser) next() {
+	for p.off < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.off]) != -1 {
+		p.off++
+	}
+	p.pos = p.off
+	p.lit = ""
+	if p.off >= len(p.src) {
+		p.tok = tokEOF
+		return
+	}
+	c := p.src[p.off]
+	switch c {
+	case '|':
+		p.tok = tokOr
+	case '+', '&':
+		p.tok = tokAnd
+	case '-':
+		p.tok = tokNot
+	case '(':
+		p.tok = tokOpen
+	case ')':
+		p.tok = tokClose
+	default:
+		end := strings.IndexAny(p.src[p.off:], operators)
+		if end == -1 {
+			end = len(p.src)
+		} else {
+			end += p.off
+		}
+		p.tok = tokTag
+		p.lit = strings.TrimSpace(p.src[p.off:end])
+		p.off = end
+		return
+	}
+	p.off++
+}
+
+func (p *parser) or() (Expr, error) {
+	var or Or
+	for {
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if sub, ok := e.(Or); ok {
+			or = append(or, sub...)
+		} else {
+			or = append(or, e)
+		}
+		if p.tok != tokOr {
+			break
+		}
+		p.next()
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	var and And
+	and = and.add(e)
+	for p.tok == tokAnd || p.tok == tokNot {
+		negate := p.tok == tokNot
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			e = Not{e}
+		}
+		and = and.add(e)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	switch p.tok {
+	case tokNot:
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{e}, nil
+	case tokOpen:
+		open := p.pos
+		p.next()
+		if p.tok == tokClose {
+			return nil, p.errorf("empty parentheses")
+		}
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != tokClose {
+			return nil, &SyntaxError{p.src, open, "unclosed parenthesis"}
+		}
+		p.next()
+		return e, nil
+	case tokTag:
+		t := Tag{p.lit}
+		p.next()
+		return t, nil
+	}
+	return nil, p.errorf("expected tag but found %s", p.describe())
+}
+
+func (p *parser) describe() string {
+	if p.tok == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", p.src[p.pos])
+}
+
+func (p *parser) errorf(format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{
+		Expr: p.src,
+		Pos:  p.pos,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// add appends e, merging in its children if e is also an And
+func (a And) add(e Expr) And {
+	if sub, ok := e.(And); ok {
+		return append(a, sub...)
+	}
+	return append(a, e)
+}
@@ -0,0 +1,167 @@
+// Package tagexpr parses and evaluates tag expressions, as used in the query of a "list" command.
+//
+// A tag expression combines tag names with these operators, from loosest to tightest:
+//
+//	|	either side (or)
+//	+ &	both sides (and)
+//	-	not the right side (and not); also usable as a prefix
+//
+// Parentheses group sub-expressions. Tag names are matched case-insensitively
+// and may contain spaces, so "Dogs+Pizza-Anime" and "Bad Ideas|(LUE&Pizza)" are both valid.
+// The empty expression matches every thread.
+package tagexpr
+
+import (
+	"strings"
+
+	"github.com/guregu/bbs"
+)
+
+// Expr is a node of a parsed tag expression.
+type Expr interface {
+	// Match reports whether a thread with the given tags satisfies the expression.
+	Match(tags []string) bool
+	// String returns the canonical form of the expression.
+	String() string
+}
+
+// Tag matches threads tagged with Name.
+type Tag struct {
+	Name string
+}
+
+func (t Tag) Match(tags []string) bool {
+	for _, tag := range tags {
+		if strings.EqualFold(tag, t.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Tag) String() string {
+	return t.Name
+}
+
+// Not matches threads that don't match Expr.
+type Not struct {
+	Expr Expr
+}
+
+func (n Not) Match(tags []string) bool {
+	return !n.Expr.Match(tags)
+}
+
+func (n Not) String() string {
+	return "-" + wrap(n.Expr, precNot)
+}
+
+// And matches threads that match all of its sub-expressions.
+// An empty And matches everything.
+type And []Expr
+
+func (a And) Match(tags []string) bool {
+	for _, e := range a {
+		if !e.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a And) String() string {
+	s := ""
+	for i, e := range a {
+		if n, ok := e.(Not); ok && i > 0 {
+			// "A+-B" is written as "A-B"
+			s += n.String()
+			continue
+		}
+		if i > 0 {
+			s += "+"
+		}
+		s += wrap(e, precAnd)
+	}
+	return s
+}
+
+// Or matches threads that match any of its sub-expressions.
+type Or []Expr
+
+func (o Or) Match(tags []string) bool {
+	for _, e := range o {
+		if e.Match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Or) String() string {
+	parts := make([]string, len(o))
+	for i, e := range o {
+		parts[i] = wrap(e, precOr)
+	}
+	return strings.Join(parts, "|")
+}
+
+const (
+	precOr = iota
+	precAnd
+	precNot
+)
+
+func precedence(e Expr) int {
+	switch e.(type) {
+	case Or:
+		return precOr
+	case And:
+		return precAnd
+	}
+	return precNot
+}
+
+// wrap parenthesizes e if it binds looser than its parent
+func wrap(e Expr, parent int) string {
+	if precedence(e) < parent {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// Canonical returns the canonical form of the tag expression s.
+// Tag names keep the case they were written in, but matching ignores case,
+// so compare canonical forms with strings.EqualFold.
+func Canonical(s string) (string, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// Match reports whether tags satisfy the tag expression s.
+func Match(s string, tags []string) (bool, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return false, err
+	}
+	return e.Match(tags), nil
+}
+
+// Filter returns the threads in a thread list matching the tag expression in m.Query.
+// Backends without their own tag search can use this to implement List.
+// The error, if any, is a *SyntaxError describing what's wrong with the query.
+func Filter(m bbs.ListCommand, threads []bbs.ThreadListing) ([]bbs.ThreadListing, error) {
+	e, err := Parse(m.Query)
+	if err != nil {
+		return nil, err
+	}
+	var matched []bbs.ThreadListing
+	for _, t := range threads {
+		if e.Match(t.Tags) {
+			matched = append(matched, t)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,111 @@
+package tagexpr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/guregu/bbs"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Expr
+		str  string
+	}{
+		{"", And{}, ""},
+		{"Dogs", Tag{"Dogs"}, "Dogs"},
+		{"Dogs+Pizza-Anime", And{Tag{"Dogs"}, Tag{"Pizza"}, Not{Tag{"Anime"}}}, "Dogs+Pizza-Anime"},
+		{"Pizza&Crime", And{Tag{"Pizza"}, Tag{"Crime"}}, "Pizza+Crime"},
+		{"A-(B|C)", And{Tag{"A"}, Not{Or{Tag{"B"}, Tag{"C"}}}}, "A-(B|C)"},
+		{"-A+B", And{Not{Tag{"A"}}, Tag{"B"}}, "-A+B"},
+		{"--A", Not{Not{Tag{"A"}}}, "--A"},
+		{"-(A+B)|C", Or{Not{And{Tag{"A"}, Tag{"B"}}}, Tag{"C"}}, "-(A+B)|C"},
+		{"(A+B)+C", And{Tag{"A"}, Tag{"B"}, Tag{"C"}}, "A+B+C"},
+		{"A|(B|C)", Or{Tag{"A"}, Tag{"B"}, Tag{"C"}}, "A|B|C"},
+		{"(A|B)+C", And{Or{Tag{"A"}, Tag{"B"}}, Tag{"C"}}, "(A|B)+C"},
+		{"Bad Ideas|(LUE&Pizza)", Or{Tag{"Bad Ideas"}, And{Tag{"LUE"}, Tag{"Pizza"}}}, "Bad Ideas|LUE+Pizza"},
+		{"  Bad Ideas | ( LUE & Pizza ) ", Or{Tag{"Bad Ideas"}, And{Tag{"LUE"}, Tag{"Pizza"}}}, "Bad Ideas|LUE+Pizza"},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(e, test.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.in, e, test.want)
+		}
+		if s := e.String(); s != test.str {
+			t.Errorf("Parse(%q).String() = %q, want %q", test.in, s, test.str)
+		}
+		// the canonical form parses back to the same thing
+		again, err := Parse(e.String())
+		if err != nil || !reflect.DeepEqual(again, e) {
+			t.Errorf("Parse(%q) didn't round-trip: %#v, %v", e.String(), again, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+	}{
+		{"A+", 2},
+		{"A++B", 2},
+		{"(A", 0},
+		{"A|(B+C", 2},
+		{"A)", 1},
+		{"()", 1},
+		{"|A", 0},
+		{"A-", 2},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.in)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("Parse(%q): got %v, want a *SyntaxError", test.in, err)
+			continue
+		}
+		if se.Pos != test.pos {
+			t.Errorf("Parse(%q): error at %d, want %d (%v)", test.in, se.Pos, test.pos, err)
+		}
+		if !errors.Is(err, bbs.ErrValidation) {
+			t.Errorf("Parse(%q): %v isn't a validation error", test.in, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		tags []string
+		want bool
+	}{
+		{"", nil, true},
+		{"Dogs", []string{"dogs"}, true},
+		{"Dogs", []string{"Cats"}, false},
+		{"Dogs+Pizza-Anime", []string{"Dogs", "Pizza"}, true},
+		{"Dogs+Pizza-Anime", []string{"Dogs", "Pizza", "anime"}, false},
+		{"Dogs+Pizza-Anime", []string{"Dogs"}, false},
+		{"A-(B|C)", []string{"A", "C"}, false},
+		{"A-(B|C)", []string{"A", "D"}, true},
+		{"-A+B", []string{"B"}, true},
+		{"--A", []string{"a"}, true},
+		{"Bad Ideas|(LUE&Pizza)", []string{"bad ideas"}, true},
+		{"Bad Ideas|(LUE&Pizza)", []string{"LUE"}, false},
+		{"Bad Ideas|(LUE&Pizza)", []string{"Pizza", "lue"}, true},
+	}
+	for _, test := range tests {
+		got, err := Match(test.expr, test.tags)
+		if err != nil {
+			t.Errorf("Match(%q): %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.expr, test.tags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package bbs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenPrefix = "v1."
+
+// DefaultTokenTTL is how long signed session tokens last if TokenSigner.TTL is zero.
+const DefaultTokenTTL = 30 * 24 * time.Hour
+
+var errBadToken = errors.New("bad session token")
+var errNoSigningKey = errors.New("no key to sign session tokens with")
+
+// SigningKey is a secret for signing session tokens. ID is put in tokens to pick the key when verifying,
+// and can't contain dots.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// TokenSigner issues HMAC-signed session tokens carrying the user ID, issue time and expiry.
+// Any server with the same keys can check them, so several replicas can share users without sharing memory.
+// The first key signs new tokens; the rest are still accepted, so keys can be rotated without logging everyone out.
+type TokenSigner struct {
+	TTL time.Duration
+
+	mu   sync.RWMutex
+	keys []SigningKey
+}
+
+// Restorer can be implemented by backends to support signed session tokens.
+// When a token made by another server shows up, the server makes a new BBS and calls Restore
+// to log it in as userID without a password. Return false if the user can't log in anymore.
+type Restorer interface {
+	Restore(userID string) bool
+}
+
+// token payload
+type claims struct {
+	UserID   string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+	Version  int    `json:"ver,omitempty"`
+}
+
+// NewTokenSigner returns a TokenSigner that signs with the first key.
+// Without any keys, logins fail until one is added with Rotate.
+// It panics if a key ID contains a dot.
+func NewTokenSigner(ttl time.Duration, keys ...SigningKey) *TokenSigner {
+	for _, k := range keys {
+		k.check()
+	}
+	return &TokenSigner{TTL: ttl, keys: keys}
+}
+
+// Rotate makes k the signing key. Older keys are kept for verifying, up to keep keys in total.
+// It panics if k's ID contains a dot.
+func (ts *TokenSigner) Rotate(k SigningKey, keep int) {
+	k.check()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.keys = append([]SigningKey{k}, ts.keys...)
+	if keep > 0 && len(ts.keys) > keep {
+		ts.keys = ts.keys[:keep]
+	}
+}
+
+// check panics if the key would make tokens that can't be verified
+func (k SigningKey) check() {
+	if strings.Contains(k.ID, ".") {
+		panic("bbs: signing key ID can't contain a dot: " + k.ID)
+	}
+}
+
+func (ts *TokenSigner) issue(userID string, version int) (string, error) {
+	ts.mu.RLock()
+	if len(ts.keys) == 0 {
+		ts.mu.RUnlock()
+		return "", errNoSigningKey
+	}
+	key := ts.keys[0]
+	ts.mu.RUnlock()
+
+	ttl := ts.TTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	now := time.Now()
+	payload, _ := json.Marshal(claims{
+		UserID:   userID,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+		Version:  version,
+	})
+	body := tokenPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + sign(key.Secret, body), nil
+}
+
+func (ts *TokenSigner) verify(token string) (claims, error) {
+	var c claims
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return c, errBadToken
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i < len(tokenPrefix) {
+		return c, errBadToken
+	}
+	parts := strings.Split(token[len(tokenPrefix):i], ".")
+	if len(parts) != 2 {
+		return c, errBadToken
+	}
+	body, sig := token[:i], token[i+1:]
+	secret := ts.secret(parts[0])
+	if secret == nil || !hmac.Equal([]byte(sig), []byte(sign(secret, body))) {
+		return c, errBadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c, errBadToken
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, errBadToken
+	}
+	if time.Now().Unix() >= c.Expires {
+		return c, ErrSessionExpired
+	}
+	return c, nil
+}
+
+func (ts *TokenSigner) secret(id string) []byte {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, k := range ts.keys {
+		if k.ID == id {
+			return k.Secret
+		}
+	}
+	return nil
+}
+
+func sign(secret []byte, body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
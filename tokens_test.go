@@ -0,0 +1,52 @@
+package bbs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	ts := NewTokenSigner(time.Hour, SigningKey{ID: "old", Secret: []byte("1")})
+	old, err := ts.issue("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Rotate(SigningKey{ID: "new", Secret: []byte("2")}, 2)
+	tok, err := ts.issue("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, user := range map[string]string{old: "alice", tok: "bob"} {
+		c, err := ts.verify(token)
+		if err != nil || c.UserID != user {
+			t.Errorf("verify(%s) = %+v, %v", token, c, err)
+		}
+	}
+	if _, err := ts.verify(tok[:len(tok)-2] + "xx"); err == nil {
+		t.Error("tampered token verified")
+	}
+	ts.Rotate(SigningKey{ID: "newer", Secret: []byte("3")}, 2)
+	if _, err := ts.verify(old); err == nil {
+		t.Error("token from a dropped key verified")
+	}
+}
+
+func TestTokenNoKeys(t *testing.T) {
+	ts := NewTokenSigner(time.Hour)
+	if _, err := ts.issue("alice", 0); err == nil {
+		t.Error("issued a token without a key")
+	}
+}
+
+func TestSigningKeyDot(t *testing.T) {
+	panics := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s accepted a key ID with a dot", name)
+			}
+		}()
+		f()
+	}
+	panics("NewTokenSigner", func() { NewTokenSigner(time.Hour, SigningKey{ID: "a.b", Secret: []byte("x")}) })
+	panics("Rotate", func() { NewTokenSigner(time.Hour).Rotate(SigningKey{ID: "a.b", Secret: []byte("x")}, 0) })
+}
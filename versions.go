@@ -0,0 +1,118 @@
+package bbs
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// Protocol versions, oldest to newest:
+//
+//	0: the original protocol, also used by clients that don't say what they speak
+//	1: error codes, sequence numbers on realtime messages
+//
+// The server speaks everything from minVersion up to version.
+const minVersion = 0
+
+// negotiate picks the newest version both sides speak, given the client's range.
+// Clients that don't send a version get version 0.
+func negotiate(clientMin, clientMax int) (int, bool) {
+	if clientMax == 0 {
+		clientMax = clientMin
+	}
+	v := clientMax
+	if v > version {
+		v = version
+	}
+	if v < clientMin || v < minVersion {
+		return 0, false
+	}
+	return v, true
+}
+
+// connVersion is the protocol version negotiated on one connection.
+// Several connections can share a session, so it's kept apart from the session's default.
+type connVersion struct {
+	mu    sync.Mutex
+	v     int
+	known bool
+}
+
+// withConnVersion gives ctx somewhere for "hello" and "login" to record the connection's version
+func withConnVersion(ctx context.Context) (context.Context, *connVersion) {
+	cv := new(connVersion)
+	return context.WithValue(ctx, versionKey, cv), cv
+}
+
+// setConnVersion records the version negotiated on ctx's connection, if it has one
+func setConnVersion(ctx context.Context, v int) {
+	if cv, ok := ctx.Value(versionKey).(*connVersion); ok {
+		cv.mu.Lock()
+		cv.v, cv.known = v, true
+		cv.mu.Unlock()
+	}
+}
+
+// get returns the connection's version, or sesh's if it hasn't negotiated one
+func (cv *connVersion) get(sesh *Session) int {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if cv.known || sesh == nil {
+		return cv.v
+	}
+	return sesh.ProtocolVersion()
+}
+
+// errorVersion guesses which version to send an error in, for a command that didn't decode
+func (srv *Server) errorVersion(data []byte) int {
+	incoming := sniffCommand(data)
+	if v, ok := negotiate(0, incoming.Version); ok && incoming.Version != 0 {
+		return v
+	}
+	if sesh := srv.Sessions.Get(incoming.Session); sesh != nil {
+		return sesh.ProtocolVersion()
+	}
+	return minVersion
+}
+
+func unsupportedVersion(wrt string) ErrorMessage {
+	msg := ErrorCode(wrt, CodeUnsupportedVersion, "no protocol version in common")
+	msg.Details = map[string]string{
+		"min": strconv.Itoa(minVersion),
+		"max": strconv.Itoa(version),
+	}
+	return msg
+}
+
+// downgrades[v] converts a version v+1 reply to version v
+var downgrades = map[int]func(interface{}) interface{}{
+	0: toVersion0,
+}
+
+// adapt converts a reply to what a client speaking protocol version v expects.
+func adapt(result interface{}, v int) interface{} {
+	for cur := version - 1; cur >= v; cur-- {
+		if down := downgrades[cur]; down != nil {
+			result = down(result)
+		}
+	}
+	return result
+}
+
+func toVersion0(result interface{}) interface{} {
+	switch m := result.(type) {
+	case ErrorMessage:
+		m.Code = ""
+		m.Details = nil
+		m.RetryAfter = 0
+		return m
+	case BatchMessage:
+		results := make([]interface{}, len(m.Results))
+		for i, r := range m.Results {
+			results[i] = toVersion0(r)
+		}
+		m.Results = results
+		return m
+	}
+	return result
+}